@@ -0,0 +1,227 @@
+package stare
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var errInvalidHash = errors.New("invalid blob hash")
+
+// BlobStore keeps attachment data on disk, addressed by the SHA-256 hash of
+// its content, so the same file is only ever stored once. The hash is taken
+// before the data is compressed and encrypted, so those blobs are deduplicated
+// too.
+type BlobStore struct {
+	dir     string
+	keyring *Keyring
+	written compressionCounter
+}
+
+func NewBlobStore(dir string, keyring *Keyring) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &BlobStore{dir: dir, keyring: keyring}, nil
+}
+
+// Put stores data and returns its hash. If the blob already exists, its
+// modification time is bumped instead so it isn't swept while the new
+// reference to it is being written.
+func (b *BlobStore) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := b.path(hash)
+
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		return hash, os.Chtimes(path, now, now)
+	}
+
+	compressed := compress(data)
+	enc, err := b.keyring.Seal(compressed)
+	if err != nil {
+		return "", err
+	}
+	if err := b.write(hash, enc); err != nil {
+		return "", err
+	}
+	b.written.add(len(data), len(compressed))
+	return hash, nil
+}
+
+// write atomically replaces the file of the blob with data.
+func (b *BlobStore) write(hash string, data []byte) error {
+	path := b.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (b *BlobStore) Get(hash string) ([]byte, error) {
+	if !validHash(hash) {
+		return nil, errInvalidHash
+	}
+	data, err := b.read(hash)
+	if err != nil {
+		return nil, err
+	}
+	return decompressBlob(hash, data), nil
+}
+
+// read returns the decrypted, but still compressed, data of the blob.
+func (b *BlobStore) read(hash string) ([]byte, error) {
+	data, err := os.ReadFile(b.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	return b.open(hash, data)
+}
+
+// open decrypts the data of a blob. Blobs written before encryption was added
+// hold the attachment itself, which can start like an encrypted value by
+// chance, so data that can't be decrypted but matches the hash is taken as
+// is.
+func (b *BlobStore) open(hash string, data []byte) ([]byte, error) {
+	dec, err := b.keyring.Open(data)
+	if err != nil {
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) == hash {
+			return data, nil
+		}
+		return nil, err
+	}
+	return dec, nil
+}
+
+// decompressBlob decompresses the data of a blob. Blobs written before
+// compression was added can start with the compression header by chance, so
+// the data is only taken as compressed if it matches the hash when
+// decompressed.
+func decompressBlob(hash string, data []byte) []byte {
+	if !isCompressed(data) {
+		return data
+	}
+	dec, err := decompress(data)
+	if err != nil {
+		return data
+	}
+	sum := sha256.Sum256(dec)
+	if hex.EncodeToString(sum[:]) != hash {
+		return data
+	}
+	return dec
+}
+
+// Stat returns the size of the blob and how much space it takes up when
+// stored, not counting encryption overhead.
+func (b *BlobStore) Stat(hash string) (size, stored int, err error) {
+	if !validHash(hash) {
+		return 0, 0, errInvalidHash
+	}
+	data, err := b.read(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(decompressBlob(hash, data)), len(data), nil
+}
+
+// CompressionStats returns the sizes of the blobs written since the store
+// was opened.
+func (b *BlobStore) CompressionStats() CompressionStats {
+	return b.written.stats()
+}
+
+// Reencrypt rewrites the blob with the active key if it was written with
+// another key, or without encryption. It reports whether the blob was
+// rewritten.
+func (b *BlobStore) Reencrypt(hash string) (bool, error) {
+	if !validHash(hash) {
+		return false, errInvalidHash
+	}
+	data, err := os.ReadFile(b.path(hash))
+	if err != nil {
+		return false, err
+	}
+	if b.keyring.IsCurrent(data) {
+		return false, nil
+	}
+
+	dec, err := b.open(hash, data)
+	if err != nil {
+		return false, err
+	}
+	enc, err := b.keyring.Seal(dec)
+	if err != nil {
+		return false, err
+	}
+	return true, b.write(hash, enc)
+}
+
+// ModTime returns the last time the blob was written.
+func (b *BlobStore) ModTime(hash string) (time.Time, error) {
+	if !validHash(hash) {
+		return time.Time{}, errInvalidHash
+	}
+	info, err := os.Stat(b.path(hash))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (b *BlobStore) Delete(hash string) error {
+	if !validHash(hash) {
+		return errInvalidHash
+	}
+	return os.Remove(b.path(hash))
+}
+
+// Walk calls fn for every stored blob with its hash and the last time it was
+// written.
+func (b *BlobStore) Walk(fn func(hash string, modTime time.Time) error) error {
+	return filepath.WalkDir(b.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !validHash(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(d.Name(), info.ModTime())
+	})
+}
+
+// path spreads blobs over subdirectories named after the first two characters
+// of their hash, to keep directories small.
+func (b *BlobStore) path(hash string) string {
+	return filepath.Join(b.dir, hash[:2], hash)
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
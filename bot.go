@@ -2,43 +2,71 @@ package stare
 
 import (
 	"context"
+	"time"
 
 	"github.com/intrntsrfr/meido/pkg/mio"
 	"github.com/intrntsrfr/meido/pkg/mio/bot"
 	"github.com/intrntsrfr/meido/pkg/utils"
+	"go.uber.org/zap"
 )
 
+// storageTimeout is how long an event handler or command may spend on
+// database and store calls before they are cancelled.
+const storageTimeout = 5 * time.Second
+
 type Bot struct {
-	Bot    *bot.Bot
-	logger mio.Logger
-	config *utils.Config
-	db     DB
-	store  *Store
+	Bot     *bot.Bot
+	logger  mio.Logger
+	config  *utils.Config
+	db      DB
+	store   Storage
+	fetcher *AttachmentFetcher
+	ctx     context.Context
+
+	storeConfig *StoreConfig
+	memberSync  memberSync
 }
 
 func NewBot(config *utils.Config, db DB) *Bot {
-	logger := newLogger("bot")
+	logger := NewLogger("bot")
 
 	b := bot.NewBotBuilder(config).
 		WithDefaultHandlers().
 		WithLogger(logger).
 		Build()
 
-	kvStore, err := NewStore(logger)
+	storeConfig, err := NewStoreConfig(config)
+	if err != nil {
+		panic(err)
+	}
+
+	store, err := NewStorage(config.GetString("store"), logger, storeConfig)
+	if err != nil {
+		panic("failed to create store")
+	}
+
+	fetcherConfig, err := NewFetcherConfig(config)
 	if err != nil {
-		panic("failed to create kvstore")
+		panic(err)
 	}
 
 	return &Bot{
-		Bot:    b,
-		db:     db,
-		logger: logger,
-		config: config,
-		store:  kvStore,
+		Bot:     b,
+		db:      db,
+		logger:  logger,
+		config:  config,
+		store:   store,
+		fetcher: NewAttachmentFetcher(store, fetcherConfig, logger),
+		ctx:     context.Background(),
+
+		storeConfig: storeConfig,
 	}
 }
 
+// Run starts the bot. Database and store calls made by event handlers are
+// cancelled once ctx is done.
 func (b *Bot) Run(ctx context.Context) error {
+	b.ctx = ctx
 	b.registerModules()
 	b.registerDiscordHandlers()
 	b.registerMioHandlers()
@@ -47,11 +75,29 @@ func (b *Bot) Run(ctx context.Context) error {
 
 func (b *Bot) Close() {
 	b.Bot.Close()
+	b.fetcher.Close()
+	if err := b.store.Close(); err != nil {
+		b.logger.Error("failed to close store", zap.Error(err))
+	}
+}
+
+// storageContext returns a context for the database and store calls of a
+// single event.
+func (b *Bot) storageContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(b.ctx, storageTimeout)
+}
+
+// messageTTL returns how long messages should be kept for in the guild.
+func (b *Bot) messageTTL(gc *Guild) time.Duration {
+	if gc.MessageRetention > 0 {
+		return time.Duration(gc.MessageRetention) * time.Hour
+	}
+	return b.storeConfig.MessageTTL
 }
 
 func (b *Bot) registerModules() {
 	modules := []bot.Module{
-		NewModule(b.Bot, b.db, b.logger),
+		NewModule(b.ctx, b.Bot, b.db, b.store, b.fetcher, b.logger),
 	}
 	for _, mod := range modules {
 		b.Bot.RegisterModule(mod)
@@ -62,6 +108,12 @@ func (b *Bot) registerDiscordHandlers() {
 	b.Bot.Discord.AddEventHandler(disconnectHandler(b))
 	b.Bot.Discord.AddEventHandler(guildBanAddHandler(b))
 	b.Bot.Discord.AddEventHandler(guildBanRemoveHandler(b))
+	b.Bot.Discord.AddEventHandler(channelCreateHandler(b))
+	b.Bot.Discord.AddEventHandler(channelUpdateHandler(b))
+	b.Bot.Discord.AddEventHandler(channelDeleteHandler(b))
+	b.Bot.Discord.AddEventHandler(guildRoleCreateHandler(b))
+	b.Bot.Discord.AddEventHandler(guildRoleUpdateHandler(b))
+	b.Bot.Discord.AddEventHandler(guildRoleDeleteHandler(b))
 	b.Bot.Discord.AddEventHandler(guildCreateHandler(b))
 	b.Bot.Discord.AddEventHandler(guildMemberAddHandler(b))
 	b.Bot.Discord.AddEventHandler(guildMemberRemoveHandler(b))
@@ -71,6 +123,7 @@ func (b *Bot) registerDiscordHandlers() {
 	b.Bot.Discord.AddEventHandler(messageDeleteBulkHandler(b))
 	b.Bot.Discord.AddEventHandler(messageDeleteHandler(b))
 	b.Bot.Discord.AddEventHandler(messageUpdateHandler(b))
+	b.Bot.Discord.AddEventHandler(voiceStateUpdateHandler(b))
 }
 
 func (b *Bot) registerMioHandlers() {
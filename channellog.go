@@ -0,0 +1,215 @@
+package stare
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// copyChannel copies the fields of a channel that are compared when it is
+// updated.
+func copyChannel(c *discordgo.Channel) *discordgo.Channel {
+	overwrites := make([]*discordgo.PermissionOverwrite, 0, len(c.PermissionOverwrites))
+	for _, o := range c.PermissionOverwrites {
+		ow := *o
+		overwrites = append(overwrites, &ow)
+	}
+	return &discordgo.Channel{
+		ID:                   c.ID,
+		GuildID:              c.GuildID,
+		Name:                 c.Name,
+		Topic:                c.Topic,
+		Type:                 c.Type,
+		NSFW:                 c.NSFW,
+		Position:             c.Position,
+		Bitrate:              c.Bitrate,
+		UserLimit:            c.UserLimit,
+		ParentID:             c.ParentID,
+		RateLimitPerUser:     c.RateLimitPerUser,
+		PermissionOverwrites: overwrites,
+	}
+}
+
+func channelTypeName(t discordgo.ChannelType) string {
+	switch t {
+	case discordgo.ChannelTypeGuildText:
+		return "Text"
+	case discordgo.ChannelTypeGuildVoice:
+		return "Voice"
+	case discordgo.ChannelTypeGuildCategory:
+		return "Category"
+	case discordgo.ChannelTypeGuildNews:
+		return "Announcement"
+	case discordgo.ChannelTypeGuildStageVoice:
+		return "Stage"
+	case discordgo.ChannelTypeGuildForum:
+		return "Forum"
+	case discordgo.ChannelTypeGuildMedia:
+		return "Media"
+	default:
+		return fmt.Sprintf("Unknown (%v)", t)
+	}
+}
+
+func formatCategory(id string) string {
+	if id == "" {
+		return "None"
+	}
+	return fmt.Sprintf("<#%v>", id)
+}
+
+// maxFieldLength is the most characters the value of an embed field can
+// have.
+const maxFieldLength = 1024
+
+// formatTopic cuts the topic short to fit in a field, as forum channels can
+// have topics of up to 4096 characters.
+func formatTopic(topic string) string {
+	if topic == "" {
+		return "None"
+	}
+	if utf8.RuneCountInString(topic) <= maxFieldLength {
+		return topic
+	}
+	return string([]rune(topic)[:maxFieldLength-1]) + "…"
+}
+
+func formatSlowmode(seconds int) string {
+	switch {
+	case seconds <= 0:
+		return "Off"
+	case seconds%3600 == 0:
+		return formatHours(seconds / 3600)
+	case seconds == 60:
+		return "1 minute"
+	case seconds%60 == 0:
+		return fmt.Sprintf("%v minutes", seconds/60)
+	case seconds == 1:
+		return "1 second"
+	default:
+		return fmt.Sprintf("%v seconds", seconds)
+	}
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// channelUpdateFields returns an embed field for every logged setting that
+// differs between old and cur. Changes to other settings, like the position
+// of the channel, are left out.
+func channelUpdateFields(old, cur *discordgo.Channel) []*discordgo.MessageEmbedField {
+	var fields []*discordgo.MessageEmbedField
+	change := func(name, before, after string) {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  name,
+			Value: fmt.Sprintf("%v → %v", before, after),
+		})
+	}
+
+	if old.Name != cur.Name {
+		change("Name", old.Name, cur.Name)
+	}
+	if old.Topic != cur.Topic {
+		fields = append(fields,
+			&discordgo.MessageEmbedField{Name: "Old topic", Value: formatTopic(old.Topic)},
+			&discordgo.MessageEmbedField{Name: "New topic", Value: formatTopic(cur.Topic)},
+		)
+	}
+	if old.RateLimitPerUser != cur.RateLimitPerUser {
+		change("Slowmode", formatSlowmode(old.RateLimitPerUser), formatSlowmode(cur.RateLimitPerUser))
+	}
+	if old.NSFW != cur.NSFW {
+		change("NSFW", formatBool(old.NSFW), formatBool(cur.NSFW))
+	}
+	if old.ParentID != cur.ParentID {
+		change("Category", formatCategory(old.ParentID), formatCategory(cur.ParentID))
+	}
+	if changes := diffOverwrites(cur.GuildID, old.PermissionOverwrites, cur.PermissionOverwrites); len(changes) > 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  "Permission overwrites",
+			Value: joinLines(changes, 1000),
+		})
+	}
+	return fields
+}
+
+// diffOverwrites describes how the permission overwrites of a channel
+// changed, one line per role or member.
+func diffOverwrites(gid string, old, cur []*discordgo.PermissionOverwrite) []string {
+	prev := make(map[string]*discordgo.PermissionOverwrite, len(old))
+	for _, o := range old {
+		prev[o.ID] = o
+	}
+
+	var lines []string
+	for _, o := range cur {
+		p, existed := prev[o.ID]
+		delete(prev, o.ID)
+		if !existed {
+			p = &discordgo.PermissionOverwrite{}
+		}
+		if existed && p.Allow == o.Allow && p.Deny == o.Deny {
+			continue
+		}
+
+		allowed := o.Allow &^ p.Allow
+		denied := o.Deny &^ p.Deny
+		reset := (p.Allow | p.Deny) &^ (o.Allow | o.Deny)
+
+		var parts []string
+		if allowed != 0 {
+			parts = append(parts, "allowed "+formatPermissions(allowed))
+		}
+		if denied != 0 {
+			parts = append(parts, "denied "+formatPermissions(denied))
+		}
+		if reset != 0 {
+			parts = append(parts, "reset "+formatPermissions(reset))
+		}
+		if len(parts) == 0 {
+			parts = append(parts, "added")
+		}
+		lines = append(lines, fmt.Sprintf("%v: %v", formatOverwriteTarget(gid, o), strings.Join(parts, "; ")))
+	}
+	for _, o := range old {
+		if _, removed := prev[o.ID]; removed {
+			lines = append(lines, fmt.Sprintf("%v: removed", formatOverwriteTarget(gid, o)))
+		}
+	}
+	return lines
+}
+
+func formatOverwriteTarget(gid string, o *discordgo.PermissionOverwrite) string {
+	switch {
+	case o.Type == discordgo.PermissionOverwriteTypeMember:
+		return fmt.Sprintf("<@%v>", o.ID)
+	case o.ID == gid:
+		return "@everyone"
+	default:
+		return fmt.Sprintf("<@&%v>", o.ID)
+	}
+}
+
+// joinLines joins lines, leaving out the ones that would make the text longer
+// than limit.
+func joinLines(lines []string, limit int) string {
+	var shown []string
+	for _, l := range lines {
+		if len(strings.Join(append(shown, l), "\n")) > limit {
+			break
+		}
+		shown = append(shown, l)
+	}
+
+	text := strings.Join(shown, "\n")
+	if len(shown) != len(lines) {
+		text += fmt.Sprintf("\nand %v more", len(lines)-len(shown))
+	}
+	return text
+}
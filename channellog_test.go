@@ -0,0 +1,29 @@
+package stare
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFormatTopic(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		want  string
+	}{
+		{"empty", "", "None"},
+		{"short", "topic", "topic"},
+		{"at the limit", strings.Repeat("a", maxFieldLength), strings.Repeat("a", maxFieldLength)},
+		{"over the limit", strings.Repeat("a", 4096), strings.Repeat("a", maxFieldLength-1) + "…"},
+		{"multibyte", strings.Repeat("é", maxFieldLength+1), strings.Repeat("é", maxFieldLength-1) + "…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatTopic(tt.topic)
+			if got != tt.want {
+				t.Errorf("formatTopic = %q (%v characters), want %q", got, utf8.RuneCountInString(got), tt.want)
+			}
+		})
+	}
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"os"
 	"os/signal"
 	"syscall"
 
@@ -13,42 +11,28 @@ import (
 
 func main() {
 	cfg := utils.NewConfig()
-	loadConfig(cfg, "./config.json")
-
-	jsonDb, err := stare.NewJsonDatabase("./data.json")
-	if err != nil {
+	if err := stare.LoadConfig(cfg, "./config.json"); err != nil {
 		panic(err)
 	}
-	defer jsonDb.Close()
-
-	bot := stare.NewBot(cfg, jsonDb)
-	defer bot.Close()
 
-	if err := bot.Run(context.Background()); err != nil {
+	db, err := stare.OpenDatabase(cfg)
+	if err != nil {
 		panic(err)
 	}
+	if size := cfg.GetInt("guild_cache_size"); size > 0 {
+		db = stare.NewCachedDB(db, size)
+	}
+	defer db.Close()
 
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
-	<-sc
-}
-
-type config struct {
-	Token  string `json:"token"`
-	Shards int    `json:"shards"`
-}
+	bot := stare.NewBot(cfg, db)
+	defer bot.Close()
 
-func loadConfig(cfg *utils.Config, path string) {
-	f, err := os.ReadFile(path)
-	if err != nil {
-		panic(err)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	var c config
-	if err := json.Unmarshal(f, &c); err != nil {
+	if err := bot.Run(ctx); err != nil {
 		panic(err)
 	}
 
-	cfg.Set("token", c.Token)
-	cfg.Set("shards", c.Shards)
+	<-ctx.Done()
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/intrntsrfr/meido/pkg/utils"
+	"github.com/intrntsrfr/stare"
+)
+
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]*command{
+	"migrate": {
+		description: "Copy guild settings from one database to another",
+		run:         runMigrate,
+	},
+	"purge": {
+		description: "Delete all stored data of a user",
+		run:         runPurge,
+	},
+	"reencrypt": {
+		description: "Re-encrypt stored messages and attachments with the active key",
+		run:         runReencrypt,
+	},
+	"stats": {
+		description: "Show how much space stored messages and attachments take up",
+		run:         runStats,
+	},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %v\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: starectl <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10v %v\n", name, commands[name].description)
+	}
+}
+
+// openDatabase opens a database given by a spec in the form <type>:<source>,
+// for example json:./data.json, sqlite:./data.db or postgres:<conn string>.
+// A JSON database keeps jsonBackups backups.
+func openDatabase(spec string, jsonBackups int) (stare.DB, error) {
+	kind, source, ok := strings.Cut(spec, ":")
+	if !ok || source == "" {
+		return nil, fmt.Errorf("invalid database spec %q, expected <type>:<source>", spec)
+	}
+
+	switch kind {
+	case "json":
+		return stare.NewJsonDatabase(source, jsonBackups)
+	case "sqlite":
+		return stare.NewSQLiteDatabase(source)
+	case "postgres":
+		return stare.NewPostgresDatabase(source)
+	default:
+		return nil, fmt.Errorf("unknown database type: %v", kind)
+	}
+}
+
+// openDatabaseReadOnly opens a database given by a spec like openDatabase does,
+// without migrating or writing to it. A JSON database falls back to its
+// jsonBackups backups if it can't be read. It returns nil if a SQLite
+// database doesn't exist yet.
+func openDatabaseReadOnly(spec string, jsonBackups int) (stare.DB, error) {
+	kind, source, ok := strings.Cut(spec, ":")
+	if !ok || source == "" {
+		return nil, fmt.Errorf("invalid database spec %q, expected <type>:<source>", spec)
+	}
+
+	switch kind {
+	case "json":
+		return stare.NewJsonDatabaseReadOnly(source, jsonBackups)
+	case "sqlite":
+		if _, err := os.Stat(source); errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return stare.NewSQLiteDatabaseReadOnly(source)
+	case "postgres":
+		return stare.NewPostgresDatabaseReadOnly(source)
+	default:
+		return nil, fmt.Errorf("unknown database type: %v", kind)
+	}
+}
+
+func loadConfig(path string) (*utils.Config, error) {
+	cfg := utils.NewConfig()
+	if err := stare.LoadConfig(cfg, path); err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return cfg, nil
+}
+
+// openStore opens the message store configured in cfg. The bot can't be
+// running at the same time.
+func openStore(cfg *utils.Config) (*stare.Store, error) {
+	storeConfig, err := stare.NewStoreConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := stare.NewStore(stare.NewLogger("starectl"), storeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	return store, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/intrntsrfr/stare"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "source database, e.g. json:./data.json")
+	to := fs.String("to", "", "destination database, e.g. sqlite:./data.db")
+	dryRun := fs.Bool("dry-run", false, "only print what would be copied, without changing the destination")
+	jsonBackups := fs.Int("json-backups", stare.DefaultJsonBackups, "number of backups of JSON databases, as json_backups in the bot config")
+	_ = fs.Parse(args)
+
+	if *from == "" || *to == "" {
+		fs.Usage()
+		return errors.New("both -from and -to are required")
+	}
+
+	ctx := context.Background()
+	src, err := openDatabaseReadOnly(*from, *jsonBackups)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	if src == nil {
+		return fmt.Errorf("source %v does not exist", *from)
+	}
+	defer src.Close()
+
+	// a dry run opens the destination read only, so it isn't created or
+	// migrated. It is nil if it doesn't exist yet.
+	var dst stare.DB
+	if *dryRun {
+		dst, err = openDatabaseReadOnly(*to, *jsonBackups)
+	} else {
+		dst, err = openDatabase(*to, *jsonBackups)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %w", err)
+	}
+	if dst != nil {
+		defer dst.Close()
+	}
+
+	guilds, err := src.GetGuilds(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read guilds: %w", err)
+	}
+
+	var created, updated, unchanged, revisions, audits int
+	for _, g := range guilds {
+		existing, err := getGuild(ctx, dst, g.ID)
+		switch {
+		case err != nil:
+			return fmt.Errorf("failed to read guild %v from destination: %w", g.ID, err)
+		case existing == nil:
+			created++
+			fmt.Printf("create %v\n", g.ID)
+			if !*dryRun {
+				if err := dst.CreateGuild(ctx, g.ID); err != nil {
+					return fmt.Errorf("failed to create guild %v: %w", g.ID, err)
+				}
+			}
+		case reflect.DeepEqual(existing, g):
+			unchanged++
+		default:
+			updated++
+			fmt.Printf("update %v\n", g.ID)
+		}
+
+		if !*dryRun && !reflect.DeepEqual(existing, g) {
+			if err := dst.UpdateGuild(ctx, g.ID, g); err != nil {
+				return fmt.Errorf("failed to update guild %v: %w", g.ID, err)
+			}
+		}
+
+		n, err := copyRevisions(ctx, src, dst, g.ID, *dryRun)
+		if err != nil {
+			return err
+		}
+		revisions += n
+
+		n, err = copyPurgeAudits(ctx, src, dst, g.ID, *dryRun)
+		if err != nil {
+			return err
+		}
+		audits += n
+	}
+
+	if *dryRun {
+		fmt.Printf("dry run, %v guilds: %v would be created, %v would be updated, %v unchanged, %v revisions and %v purge audits would be copied\n",
+			len(guilds), created, updated, unchanged, revisions, audits)
+		return nil
+	}
+	fmt.Printf("%v guilds: %v created, %v updated, %v unchanged, %v revisions and %v purge audits copied\n",
+		len(guilds), created, updated, unchanged, revisions, audits)
+
+	return verify(ctx, guilds, src, dst)
+}
+
+// getGuild returns nil if the guild isn't in db, or db is nil.
+func getGuild(ctx context.Context, db stare.DB, gid string) (*stare.Guild, error) {
+	if db == nil {
+		return nil, nil
+	}
+	g, err := db.GetGuild(ctx, gid)
+	if errors.Is(err, stare.ErrGuildNotFound) {
+		return nil, nil
+	}
+	return g, err
+}
+
+// copyRevisions copies the settings history of a guild that dst doesn't have
+// yet, oldest first so they keep their revision numbers. dst only has to be
+// set when it's not a dry run.
+func copyRevisions(ctx context.Context, src, dst stare.DB, gid string, dryRun bool) (int, error) {
+	revisions, err := src.GetGuildRevisions(ctx, gid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read revisions of guild %v: %w", gid, err)
+	}
+
+	latest := 0
+	if dst != nil {
+		copied, err := dst.GetGuildRevisions(ctx, gid)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read revisions of guild %v from destination: %w", gid, err)
+		}
+		if len(copied) > 0 {
+			latest = copied[0].Revision
+		}
+	}
+
+	n := 0
+	for i := len(revisions) - 1; i >= 0; i-- {
+		rev := *revisions[i]
+		if rev.Revision <= latest {
+			continue
+		}
+		n++
+		if dryRun {
+			continue
+		}
+		if err := dst.CreateGuildRevision(ctx, &rev); err != nil {
+			return n, fmt.Errorf("failed to copy revision %v of guild %v: %w", rev.Revision, gid, err)
+		}
+	}
+	if n > 0 {
+		fmt.Printf("copy %v revisions of %v\n", n, gid)
+	}
+	return n, nil
+}
+
+// copyPurgeAudits copies the purge audits of a guild that are newer than the
+// newest one dst has, oldest first. dst only has to be set when it's not a
+// dry run.
+func copyPurgeAudits(ctx context.Context, src, dst stare.DB, gid string, dryRun bool) (int, error) {
+	audits, err := src.GetPurgeAudits(ctx, gid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read purge audits of guild %v: %w", gid, err)
+	}
+
+	var latest time.Time
+	if dst != nil {
+		copied, err := dst.GetPurgeAudits(ctx, gid)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read purge audits of guild %v from destination: %w", gid, err)
+		}
+		if len(copied) > 0 {
+			latest = copied[0].CreatedAt
+		}
+	}
+
+	n := 0
+	for i := len(audits) - 1; i >= 0; i-- {
+		audit := *audits[i]
+		if !audit.CreatedAt.After(latest) {
+			continue
+		}
+		n++
+		if dryRun {
+			continue
+		}
+		if err := dst.CreatePurgeAudit(ctx, &audit); err != nil {
+			return n, fmt.Errorf("failed to copy purge audit of guild %v: %w", gid, err)
+		}
+	}
+	if n > 0 {
+		fmt.Printf("copy %v purge audits of %v\n", n, gid)
+	}
+	return n, nil
+}
+
+// verify reads every guild back from dst and checks that it matches the
+// source exactly, and that it has every revision and purge audit of the
+// source.
+func verify(ctx context.Context, guilds []*stare.Guild, src, dst stare.DB) error {
+	var mismatched int
+	for _, g := range guilds {
+		copied, err := dst.GetGuild(ctx, g.ID)
+		if err != nil {
+			mismatched++
+			fmt.Printf("verify %v: %v\n", g.ID, err)
+			continue
+		}
+		if !reflect.DeepEqual(copied, g) {
+			mismatched++
+			fmt.Printf("verify %v: expected %+v, got %+v\n", g.ID, g, copied)
+			continue
+		}
+
+		want, err := src.GetGuildRevisions(ctx, g.ID)
+		if err != nil {
+			return err
+		}
+		got, err := dst.GetGuildRevisions(ctx, g.ID)
+		if err != nil {
+			mismatched++
+			fmt.Printf("verify %v: %v\n", g.ID, err)
+			continue
+		}
+		if latestRevision(got) < latestRevision(want) {
+			mismatched++
+			fmt.Printf("verify %v: expected revisions up to %v, got up to %v\n", g.ID, latestRevision(want), latestRevision(got))
+			continue
+		}
+
+		wantAudits, err := src.GetPurgeAudits(ctx, g.ID)
+		if err != nil {
+			return err
+		}
+		gotAudits, err := dst.GetPurgeAudits(ctx, g.ID)
+		if err != nil {
+			mismatched++
+			fmt.Printf("verify %v: %v\n", g.ID, err)
+			continue
+		}
+		if len(gotAudits) < len(wantAudits) {
+			mismatched++
+			fmt.Printf("verify %v: expected %v purge audits, got %v\n", g.ID, len(wantAudits), len(gotAudits))
+		}
+	}
+
+	if mismatched > 0 {
+		return fmt.Errorf("%v guilds did not match after copying", mismatched)
+	}
+	fmt.Printf("verified %v guilds\n", len(guilds))
+	return nil
+}
+
+// latestRevision returns the number of the newest of revisions, which are
+// sorted newest first.
+func latestRevision(revisions []*stare.GuildRevision) int {
+	if len(revisions) == 0 {
+		return 0
+	}
+	return revisions[0].Revision
+}
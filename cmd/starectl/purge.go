@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/intrntsrfr/stare"
+)
+
+func runPurge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	configPath := fs.String("config", "./config.json", "bot config file with the store and database settings")
+	user := fs.String("user", "", "ID of the user to delete the data of")
+	guild := fs.String("guild", "", "only delete the data in this guild instead of in every guild")
+	actor := fs.String("actor", "", "user ID recorded as having done the purge, defaults to the first of owner_ids")
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	_ = fs.Parse(args)
+
+	if *user == "" {
+		fs.Usage()
+		return errors.New("-user is required")
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	// the bot keeps a JSON database in memory and writes all of it back on
+	// every change, which would drop the purge audit if it is running
+	if db := cfg.GetString("database"); db == "json" || db == "" {
+		return errors.New("purging needs a SQL database to record the purge in, use /privacy purge instead")
+	}
+	if *actor == "" {
+		if owners := cfg.GetStringSlice("owner_ids"); len(owners) > 0 {
+			*actor = owners[0]
+		}
+	}
+	if *actor == "" {
+		return errors.New("-actor is required when owner_ids isn't set")
+	}
+
+	if !*yes {
+		where := "every guild"
+		if *guild != "" {
+			where = "guild " + *guild
+		}
+		fmt.Printf("This deletes every stored message, attachment and the member history of user %v in %v.\n", *user, where)
+		fmt.Print("Type the user ID to confirm: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != *user {
+			return errors.New("not confirmed")
+		}
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	db, err := stare.OpenDatabase(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	result, purgeErr := store.PurgeUser(ctx, *guild, *user)
+	if result != nil {
+		fmt.Printf("deleted %v messages, %v attachments and %v member records in %v guilds\n",
+			result.Messages, result.Attachments, result.MemberRecords, len(result.Guilds))
+	}
+
+	// record the purge in every guild it touched, even if it failed halfway
+	guilds := []string{}
+	if result != nil {
+		guilds = result.Guilds
+	}
+	if *guild != "" && len(guilds) == 0 {
+		guilds = []string{*guild}
+	}
+	var auditErr error
+	for _, gid := range guilds {
+		audit := &stare.PurgeAudit{
+			GuildID:   gid,
+			UserID:    *user,
+			ActorID:   *actor,
+			CreatedAt: time.Now(),
+		}
+		if err := db.CreatePurgeAudit(ctx, audit); err != nil {
+			fmt.Printf("failed to record the purge in guild %v: %v\n", gid, err)
+			auditErr = errors.New("the purge could not be recorded in every guild")
+		}
+	}
+
+	if purgeErr != nil {
+		return purgeErr
+	}
+	return auditErr
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+func runReencrypt(args []string) error {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	configPath := fs.String("config", "./config.json", "bot config file with the store settings and encryption keys")
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if !store.Encrypted() {
+		return errors.New("no encryption keys configured")
+	}
+
+	result, err := store.Reencrypt(context.Background())
+	fmt.Printf("re-encrypted %v messages and %v attachments\n", result.Messages, result.Attachments)
+	if err != nil {
+		return err
+	}
+	if result.Undecryptable > 0 {
+		return fmt.Errorf("%v messages and attachments could not be decrypted with the configured keys", result.Undecryptable)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/intrntsrfr/stare"
+)
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	configPath := fs.String("config", "./config.json", "bot config file with the store settings")
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	stats, err := store.Stats(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("messages:    %v, %v stored, %v uncompressed, %.2fx\n", stats.Messages,
+		stare.FormatBytes(stats.MessageBytes.StoredBytes), stare.FormatBytes(stats.MessageBytes.RawBytes), stats.MessageBytes.Ratio())
+	fmt.Printf("attachments: %v, %v stored, %v uncompressed, %.2fx\n", stats.Attachments,
+		stare.FormatBytes(stats.AttachmentBytes.StoredBytes), stare.FormatBytes(stats.AttachmentBytes.RawBytes), stats.AttachmentBytes.Ratio())
+	return nil
+}
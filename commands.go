@@ -1,8 +1,12 @@
 package stare
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,23 +15,36 @@ import (
 	"github.com/intrntsrfr/meido/pkg/mio/bot"
 	"github.com/intrntsrfr/meido/pkg/mio/discord"
 	"github.com/intrntsrfr/meido/pkg/utils/builders"
+	"go.uber.org/zap"
 )
 
 type module struct {
 	*bot.ModuleBase
 	startTime time.Time
 	db        DB
+	store     Storage
+	fetcher   *AttachmentFetcher
+	ctx       context.Context
 }
 
-func NewModule(b *bot.Bot, db DB, logger mio.Logger) *module {
+func NewModule(ctx context.Context, b *bot.Bot, db DB, store Storage, fetcher *AttachmentFetcher, logger mio.Logger) *module {
 	logger = logger.Named("commands")
 	return &module{
 		ModuleBase: bot.NewModule(b, "commands", logger),
 		db:         db,
+		store:      store,
+		fetcher:    fetcher,
 		startTime:  time.Now(),
+		ctx:        ctx,
 	}
 }
 
+// storageContext returns a context for the database calls of a single
+// command.
+func (m *module) storageContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(m.ctx, storageTimeout)
+}
+
 func (m *module) Hook() error {
 	if err := m.RegisterCommands(); err != nil {
 		return err
@@ -36,6 +53,14 @@ func (m *module) Hook() error {
 		newInfoSlash(m),
 		newHelpSlash(m),
 		newSettingsSlash(m),
+		newWhoisSlash(m),
+		newPrivacySlash(m),
+		newStorageSlash(m),
+	); err != nil {
+		return err
+	}
+	if err := m.RegisterMessageComponents(
+		newPurgeConfirmComponent(m),
 	); err != nil {
 		return err
 	}
@@ -58,6 +83,10 @@ func newHelpSlash(m *module) *bot.ModuleApplicationCommand {
 		text.WriteString("1. When a message is edited\n")
 		text.WriteString("1. When a user is banned\n")
 		text.WriteString("1. When a user is unbanned\n")
+		text.WriteString("1. When a member's nickname or roles change\n")
+		text.WriteString("1. When a channel is created, updated or deleted\n")
+		text.WriteString("1. When a role is created, updated or deleted\n")
+		text.WriteString("1. When a user joins, leaves or moves between voice channels, is server muted or deafened, or streams\n")
 		text.WriteString("\n")
 		text.WriteString("To view the current settings, use the `/settings view` command\n")
 		text.WriteString("To set a log channel, use the `/settings set` command\n")
@@ -85,30 +114,81 @@ func newInfoSlash(m *module) *bot.ModuleApplicationCommand {
 			AddField("Golang version", runtime.Version(), false).
 			AddField("Running since", fmt.Sprintf("<t:%v:R>", m.startTime.Unix()), false).
 			AddField("Total guilds", fmt.Sprintf("%v", d.Discord.GuildCount()), false)
+		if cache, ok := m.db.(*CachedDB); ok {
+			stats := cache.Stats()
+			embed.AddField("Guild cache", fmt.Sprintf("%v cached, %v hits, %v misses", stats.Size, stats.Hits, stats.Misses), false)
+		}
+		fetcherStats := m.fetcher.Stats()
+		embed.AddField("Attachment queue", fmt.Sprintf("%v queued, %v dropped", fetcherStats.QueueDepth, fetcherStats.Dropped), false)
+		if store, ok := m.store.(*Store); ok {
+			messages, attachments := store.CompressionStats()
+			embed.AddField("Compression", fmt.Sprintf("Messages %.2fx, attachments %.2fx since start",
+				messages.Ratio(), attachments.Ratio()), false)
+		}
 		d.RespondEmbed(embed.Build())
 	}
 
 	return cmd.Execute(run).Build()
 }
 
-func newSettingsSlash(m *module) *bot.ModuleApplicationCommand {
-	logTypes := map[string]string{
-		"join":      "User Join",
-		"leave":     "User Leave",
-		"msgdelete": "Message Delete",
-		"msgedit":   "Message Edit",
-		"ban":       "User Ban",
-		"unban":     "User Unban",
+func newStorageSlash(m *module) *bot.ModuleApplicationCommand {
+	cmd := bot.NewModuleApplicationCommandBuilder(m, "storage").
+		Type(discordgo.ChatApplicationCommand).
+		Description("View how much this server stores and its quotas").
+		NoDM().
+		Permissions(discordgo.PermissionManageServer)
+
+	run := func(d *discord.DiscordApplicationCommand) {
+		ctx, cancel := m.storageContext()
+		defer cancel()
+
+		usage, err := m.store.GuildUsage(ctx, d.GuildID())
+		if err != nil {
+			m.Logger.Error("failed to get guild usage", zap.String("guild", d.GuildID()), zap.Error(err))
+			d.Respond("Failed to get storage usage")
+			return
+		}
+		d.RespondEmbed(generateStorageEmbed(usage))
 	}
 
-	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(logTypes))
-	for k, v := range logTypes {
+	return cmd.Execute(run).Build()
+}
+
+func generateStorageEmbed(usage *GuildUsage) *discordgo.MessageEmbed {
+	messages := fmt.Sprintf("%v", usage.Messages)
+	if usage.MaxMessages > 0 {
+		messages = fmt.Sprintf("%v of %v (%v%%)", usage.Messages, usage.MaxMessages,
+			usage.Messages*100/usage.MaxMessages)
+	}
+	size := FormatBytes(uint64(usage.Bytes))
+	if usage.MaxBytes > 0 {
+		size = fmt.Sprintf("%v of %v (%v%%)", size, FormatBytes(uint64(usage.MaxBytes)),
+			usage.Bytes*100/usage.MaxBytes)
+	}
+
+	embed := builders.NewEmbedBuilder().
+		WithTitle("Storage").
+		WithOkColor().
+		AddField("Messages", messages, true).
+		AddField("Size", size, true)
+	if usage.MaxMessages > 0 || usage.MaxBytes > 0 {
+		embed.WithFooter("The oldest messages are removed when a quota is reached", "")
+	} else {
+		embed.WithFooter("This server has no quota", "")
+	}
+	return embed.Build()
+}
+
+func newSettingsSlash(m *module) *bot.ModuleApplicationCommand {
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(logSettings))
+	for _, setting := range logSettings {
 		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
-			Name:  v,
-			Value: k,
+			Name:  setting.Choice,
+			Value: setting.Name,
 		})
 	}
 
+	minRevision, minRetention := float64(0), float64(0)
 	cmd := bot.NewModuleApplicationCommandBuilder(m, "settings").
 		Type(discordgo.ChatApplicationCommand).
 		Description("View or set the current settings").
@@ -138,10 +218,47 @@ func newSettingsSlash(m *module) *bot.ModuleApplicationCommand {
 					Required:    true,
 				},
 			},
+		}).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "retention",
+			Description: "Set how long messages are kept for",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "hours",
+					Description: "How many hours to keep messages for, 0 uses the default",
+					Required:    true,
+					MinValue:    &minRetention,
+					MaxValue:    maxMessageRetention,
+				},
+			},
+		}).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "history",
+			Description: "View the latest changes to the settings",
+		}).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "rollback",
+			Description: "Restore the settings to how they were after a revision",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "revision",
+					Description: "The revision to restore, 0 restores the settings from before any changes",
+					Required:    true,
+					MinValue:    &minRevision,
+				},
+			},
 		})
 
 	run := func(d *discord.DiscordApplicationCommand) {
-		gc, err := m.db.GetGuild(d.GuildID())
+		ctx, cancel := m.storageContext()
+		defer cancel()
+
+		gc, err := m.db.GetGuild(ctx, d.GuildID())
 		if err != nil {
 			d.Respond("Failed to get guild config")
 			return
@@ -156,7 +273,11 @@ func newSettingsSlash(m *module) *bot.ModuleApplicationCommand {
 				d.Respond("Log type not found")
 				return
 			}
-			logTypeStr := logType.StringValue()
+			setting, ok := findLogSetting(logType.StringValue())
+			if !ok {
+				d.Respond("Log type not found")
+				return
+			}
 
 			chOpt, ok := d.Options("set:channel")
 			if !ok {
@@ -170,28 +291,125 @@ func newSettingsSlash(m *module) *bot.ModuleApplicationCommand {
 				return
 			}
 
-			switch logTypeStr {
-			case "join":
-				gc.JoinLog = ch.ID
-			case "leave":
-				gc.LeaveLog = ch.ID
-			case "msgdelete":
-				gc.MsgDeleteLog = ch.ID
-			case "msgedit":
-				gc.MsgEditLog = ch.ID
-			case "ban":
-				gc.BanLog = ch.ID
-			case "unban":
-				gc.UnbanLog = ch.ID
+			rev := &GuildRevision{
+				GuildID:   d.GuildID(),
+				ActorID:   d.AuthorID(),
+				Field:     setting.Name,
+				OldValue:  setting.Set(gc, ch.ID),
+				NewValue:  ch.ID,
+				CreatedAt: time.Now(),
+			}
+
+			if err := m.updateSettings(ctx, gc, rev); err != nil {
+				m.Logger.Error("failed to update server config", zap.Error(err))
+				d.Respond("Failed to update server config")
+				return
+			}
+
+			embed := generateLogSettingsEmbed(gc)
+			embed.Title = "Updated settings"
+
+			resp := &discordgo.InteractionResponseData{
+				Embeds: []*discordgo.MessageEmbed{embed},
+				Flags:  discordgo.MessageFlagsEphemeral,
+			}
+
+			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+			return
+		} else if _, ok := d.Options("retention"); ok {
+			hoursOpt, ok := d.Options("retention:hours")
+			if !ok {
+				d.Respond("Hours not found")
+				return
+			}
+			hours := strconv.FormatInt(hoursOpt.IntValue(), 10)
+
+			rev := &GuildRevision{
+				GuildID:   d.GuildID(),
+				ActorID:   d.AuthorID(),
+				Field:     retentionSetting.Name,
+				OldValue:  retentionSetting.Set(gc, hours),
+				NewValue:  hours,
+				CreatedAt: time.Now(),
 			}
 
-			if err := m.db.UpdateGuild(d.GuildID(), gc); err != nil {
+			if err := m.updateSettings(ctx, gc, rev); err != nil {
+				m.Logger.Error("failed to update server config", zap.Error(err))
 				d.Respond("Failed to update server config")
 				return
 			}
 
 			embed := generateLogSettingsEmbed(gc)
 			embed.Title = "Updated settings"
+			embed.Description = "The new retention applies to messages sent from now on"
+
+			resp := &discordgo.InteractionResponseData{
+				Embeds: []*discordgo.MessageEmbed{embed},
+				Flags:  discordgo.MessageFlagsEphemeral,
+			}
+
+			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+			return
+		} else if _, ok := d.Options("history"); ok {
+			revisions, err := m.db.GetGuildRevisions(ctx, d.GuildID())
+			if err != nil {
+				d.Respond("Failed to get settings history")
+				return
+			}
+			d.RespondEmbed(generateSettingsHistoryEmbed(revisions))
+			return
+		} else if _, ok := d.Options("rollback"); ok {
+			revOpt, ok := d.Options("rollback:revision")
+			if !ok {
+				d.Respond("Revision not found")
+				return
+			}
+
+			revisions, err := m.db.GetGuildRevisions(ctx, d.GuildID())
+			if err != nil {
+				d.Respond("Failed to get settings history")
+				return
+			}
+
+			target := int(revOpt.IntValue())
+			if len(revisions) == 0 || target > revisions[0].Revision {
+				d.Respond(fmt.Sprintf("Revision %v does not exist", target))
+				return
+			}
+
+			// revisions are newest first, so undoing them in order walks the
+			// settings back to how they were right after the target revision
+			before := *gc
+			for _, r := range revisions {
+				if r.Revision <= target {
+					break
+				}
+				if setting, ok := findSetting(r.Field); ok {
+					setting.Set(gc, r.OldValue)
+				}
+			}
+
+			// the restored fields are recorded as new revisions, so a rollback
+			// can be rolled back as well
+			var revs []*GuildRevision
+			for _, setting := range guildSettings {
+				revs = append(revs, &GuildRevision{
+					GuildID:   d.GuildID(),
+					ActorID:   d.AuthorID(),
+					Field:     setting.Name,
+					OldValue:  setting.Get(&before),
+					NewValue:  setting.Get(gc),
+					CreatedAt: time.Now(),
+				})
+			}
+			if err := m.updateSettings(ctx, gc, revs...); err != nil {
+				m.Logger.Error("failed to update server config", zap.Error(err))
+				d.Respond("Failed to update server config")
+				return
+			}
+
+			embed := generateLogSettingsEmbed(gc)
+			embed.Title = fmt.Sprintf("Restored settings to revision %v", target)
 
 			resp := &discordgo.InteractionResponseData{
 				Embeds: []*discordgo.MessageEmbed{embed},
@@ -209,13 +427,426 @@ func newSettingsSlash(m *module) *bot.ModuleApplicationCommand {
 func generateLogSettingsEmbed(gc *Guild) *discordgo.MessageEmbed {
 	embed := builders.NewEmbedBuilder().
 		WithTitle("Settings").
+		WithOkColor()
+	for _, setting := range guildSettings {
+		embed.AddField(setting.Title, setting.Format(setting.Get(gc)), true)
+	}
+
+	return embed.Build()
+}
+
+// updateSettings stores gc together with a revision for each of revs that
+// changed a setting. Nothing is stored if none of them did.
+func (m *module) updateSettings(ctx context.Context, gc *Guild, revs ...*GuildRevision) error {
+	var changed []*GuildRevision
+	for _, rev := range revs {
+		if rev.OldValue != rev.NewValue {
+			changed = append(changed, rev)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return m.db.UpdateGuildSettings(ctx, gc.ID, gc, changed)
+}
+
+// maxMessageRetention is the longest message retention in hours a guild can
+// set.
+const maxMessageRetention = 30 * 24
+
+// maxHistoryRevisions is the number of revisions shown by /settings history.
+const maxHistoryRevisions = 15
+
+func generateSettingsHistoryEmbed(revisions []*GuildRevision) *discordgo.MessageEmbed {
+	embed := builders.NewEmbedBuilder().
+		WithTitle("Settings history").
+		WithOkColor()
+
+	if len(revisions) == 0 {
+		return embed.WithDescription("No changes have been made yet").Build()
+	}
+
+	text := strings.Builder{}
+	for i, r := range revisions {
+		if i >= maxHistoryRevisions {
+			text.WriteString(fmt.Sprintf("\n...and %v older revisions", len(revisions)-i))
+			break
+		}
+
+		name, oldValue, newValue := r.Field, r.OldValue, r.NewValue
+		if setting, ok := findSetting(r.Field); ok {
+			name = setting.Title
+			oldValue = setting.Format(r.OldValue)
+			newValue = setting.Format(r.NewValue)
+		}
+		text.WriteString(fmt.Sprintf("**#%v** <t:%v:f> by <@%v>\n%v: %v → %v\n",
+			r.Revision, r.CreatedAt.Unix(), r.ActorID, name, oldValue, newValue))
+	}
+	embed.WithDescription(text.String())
+	embed.WithFooter("Use /settings rollback to restore an earlier revision", "")
+
+	return embed.Build()
+}
+
+func newWhoisSlash(m *module) *bot.ModuleApplicationCommand {
+	cmd := bot.NewModuleApplicationCommandBuilder(m, "whois").
+		Type(discordgo.ChatApplicationCommand).
+		Description("Look up members").
+		NoDM().
+		Permissions(discordgo.PermissionModerateMembers).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "history",
+			Description: "View how the names, roles and avatar of a member changed over time",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionUser,
+					Name:        "user",
+					Description: "The member to look up, can be someone who left",
+					Required:    true,
+				},
+			},
+		})
+
+	run := func(d *discord.DiscordApplicationCommand) {
+		ctx, cancel := m.storageContext()
+		defer cancel()
+
+		if _, ok := d.Options("history"); ok {
+			userOpt, ok := d.Options("history:user")
+			if !ok {
+				d.Respond("User not found")
+				return
+			}
+			user := userOpt.UserValue(nil)
+
+			history, err := m.store.GetMemberHistory(ctx, d.GuildID(), user.ID)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				d.Respond("Failed to get member history")
+				return
+			}
+
+			resp := &discordgo.InteractionResponseData{
+				Embeds: []*discordgo.MessageEmbed{generateMemberHistoryEmbed(user.ID, history)},
+				Flags:  discordgo.MessageFlagsEphemeral,
+			}
+			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+			return
+		}
+	}
+
+	return cmd.Execute(run).Build()
+}
+
+// maxHistorySnapshots is the number of changes shown by /whois history.
+const maxHistorySnapshots = 15
+
+func generateMemberHistoryEmbed(uid string, history []*MemberSnapshot) *discordgo.MessageEmbed {
+	embed := builders.NewEmbedBuilder().
+		WithTitle("Member history").
 		WithOkColor().
-		AddField("Join log", fmt.Sprintf("<#%v>", gc.JoinLog), true).
-		AddField("Leave log", fmt.Sprintf("<#%v>", gc.LeaveLog), true).
-		AddField("Message delete log", fmt.Sprintf("<#%v>", gc.MsgDeleteLog), true).
-		AddField("Message edit log", fmt.Sprintf("<#%v>", gc.MsgEditLog), true).
-		AddField("Ban log", fmt.Sprintf("<#%v>", gc.BanLog), true).
-		AddField("Unban log", fmt.Sprintf("<#%v>", gc.UnbanLog), true)
+		WithFooter(fmt.Sprintf("User ID: %v", uid), "")
+
+	if len(history) == 0 {
+		return embed.WithDescription(fmt.Sprintf("No history is stored for <@%v>", uid)).Build()
+	}
+
+	text := strings.Builder{}
+	text.WriteString(fmt.Sprintf("<@%v>\n", uid))
+	for i := len(history) - 1; i >= 0; i-- {
+		snapshot := history[i]
+		entry := fmt.Sprintf("\n<t:%v:f>\n", snapshot.Timestamp.Unix())
+		if i == 0 {
+			entry += describeSnapshot(snapshot)
+		} else {
+			entry += describeSnapshotChanges(history[i-1], snapshot)
+		}
+
+		// leave room for the line about the older changes in the 4096
+		// characters of an embed description
+		shown := len(history) - 1 - i
+		if shown >= maxHistorySnapshots || text.Len()+len(entry) > 4000 {
+			text.WriteString(fmt.Sprintf("\n...and %v older changes", i+1))
+			break
+		}
+		text.WriteString(entry)
+	}
+	embed.WithDescription(text.String())
 
 	return embed.Build()
 }
+
+// describeSnapshot describes the first snapshot of a member.
+func describeSnapshot(s *MemberSnapshot) string {
+	text := strings.Builder{}
+	text.WriteString(fmt.Sprintf("First seen as %v\n", formatNames(s)))
+	if s.Nick != "" {
+		text.WriteString(fmt.Sprintf("Nickname: %v\n", s.Nick))
+	}
+	if len(s.Roles) > 0 {
+		text.WriteString(fmt.Sprintf("Roles: %v\n", formatRoles(s.Roles)))
+	}
+	return text.String()
+}
+
+// describeSnapshotChanges describes what changed between two snapshots of a
+// member.
+func describeSnapshotChanges(prev, cur *MemberSnapshot) string {
+	text := strings.Builder{}
+	if prev.Username != cur.Username || prev.GlobalName != cur.GlobalName {
+		text.WriteString(fmt.Sprintf("Name: %v → %v\n", formatNames(prev), formatNames(cur)))
+	}
+	if prev.Nick != cur.Nick {
+		text.WriteString(fmt.Sprintf("Nickname: %v → %v\n", formatNick(prev.Nick), formatNick(cur.Nick)))
+	}
+	added, removed := diffRoles(prev.Roles, cur.Roles)
+	if len(added) > 0 {
+		text.WriteString(fmt.Sprintf("Roles added: %v\n", formatRoles(added)))
+	}
+	if len(removed) > 0 {
+		text.WriteString(fmt.Sprintf("Roles removed: %v\n", formatRoles(removed)))
+	}
+	if prev.Avatar != cur.Avatar {
+		text.WriteString("Server avatar changed\n")
+	}
+	return text.String()
+}
+
+func formatNames(s *MemberSnapshot) string {
+	if s.GlobalName == "" || s.GlobalName == s.Username {
+		return s.Username
+	}
+	return fmt.Sprintf("%v (%v)", s.GlobalName, s.Username)
+}
+
+func formatNick(nick string) string {
+	if nick == "" {
+		return "None"
+	}
+	return nick
+}
+
+func formatRoles(roles []string) string {
+	mentions := make([]string, 0, len(roles))
+	for _, r := range roles {
+		mentions = append(mentions, fmt.Sprintf("<@&%v>", r))
+	}
+	return strings.Join(mentions, ", ")
+}
+
+// diffRoles returns the roles that are in cur but not prev, and the ones that
+// are in prev but not cur.
+func diffRoles(prev, cur []string) (added, removed []string) {
+	for _, r := range cur {
+		if !slices.Contains(prev, r) {
+			added = append(added, r)
+		}
+	}
+	for _, r := range prev {
+		if !slices.Contains(cur, r) {
+			removed = append(removed, r)
+		}
+	}
+	return added, removed
+}
+
+func newPrivacySlash(m *module) *bot.ModuleApplicationCommand {
+	cmd := bot.NewModuleApplicationCommandBuilder(m, "privacy").
+		Type(discordgo.ChatApplicationCommand).
+		Description("Manage the data stored about users").
+		NoDM().
+		Permissions(discordgo.PermissionAdministrator).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "purge",
+			Description: "Delete all stored messages, attachments and member history of a user",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionUser,
+					Name:        "user",
+					Description: "The user to delete the data of, can be someone who left",
+					Required:    true,
+				},
+			},
+		}).
+		AddSubcommand(&discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "log",
+			Description: "Show whose data has been purged",
+		})
+
+	run := func(d *discord.DiscordApplicationCommand) {
+		if _, ok := d.Options("log"); ok {
+			ctx, cancel := m.storageContext()
+			defer cancel()
+
+			audits, err := m.db.GetPurgeAudits(ctx, d.GuildID())
+			if err != nil {
+				d.Respond("Failed to get purge log")
+				return
+			}
+			d.RespondEmbed(generatePurgeLogEmbed(audits))
+			return
+		}
+
+		if _, ok := d.Options("purge"); ok {
+			userOpt, ok := d.Options("purge:user")
+			if !ok {
+				d.Respond("User not found")
+				return
+			}
+			user := userOpt.UserValue(nil)
+
+			embed := builders.NewEmbedBuilder().
+				WithTitle("Purge user data").
+				WithColor(int(ColorRed)).
+				WithDescription(fmt.Sprintf("This deletes every stored message, attachment and the member history of <@%v> in this server. "+
+					"It can't be undone.", user.ID)).
+				WithFooter(fmt.Sprintf("User ID: %v", user.ID), "")
+
+			resp := &discordgo.InteractionResponseData{
+				Embeds: []*discordgo.MessageEmbed{embed.Build()},
+				Flags:  discordgo.MessageFlagsEphemeral,
+				Components: []discordgo.MessageComponent{
+					discordgo.ActionsRow{
+						Components: []discordgo.MessageComponent{
+							discordgo.Button{
+								Label:    "Purge",
+								Style:    discordgo.DangerButton,
+								CustomID: purgeCustomID("confirm", user.ID, d.AuthorID()),
+							},
+							discordgo.Button{
+								Label:    "Cancel",
+								Style:    discordgo.SecondaryButton,
+								CustomID: purgeCustomID("cancel", user.ID, d.AuthorID()),
+							},
+						},
+					},
+				},
+			}
+			d.RespondComplex(resp, discordgo.InteractionResponseChannelMessageWithSource)
+			return
+		}
+	}
+
+	return cmd.Execute(run).Build()
+}
+
+// maxPurgeLogEntries is the number of purges shown by /privacy log.
+const maxPurgeLogEntries = 15
+
+func generatePurgeLogEmbed(audits []*PurgeAudit) *discordgo.MessageEmbed {
+	embed := builders.NewEmbedBuilder().
+		WithTitle("Purge log").
+		WithOkColor()
+
+	if len(audits) == 0 {
+		return embed.WithDescription("No data has been purged yet").Build()
+	}
+
+	text := strings.Builder{}
+	for i, a := range audits {
+		if i >= maxPurgeLogEntries {
+			text.WriteString(fmt.Sprintf("\n...and %v older purges", len(audits)-i))
+			break
+		}
+		text.WriteString(fmt.Sprintf("<t:%v:f> by <@%v>\nPurged the data of <@%v> (%v)\n",
+			a.CreatedAt.Unix(), a.ActorID, a.UserID, a.UserID))
+	}
+	return embed.WithDescription(text.String()).Build()
+}
+
+// purgeTimeout is how long purging the data of a user may take.
+const purgeTimeout = time.Minute
+
+// purgeCustomID is the custom ID of the buttons confirming a purge, which
+// carry the action, the user to purge and the user who asked for it.
+func purgeCustomID(action, uid, actorID string) string {
+	return fmt.Sprintf("privacy_purge:%v:%v:%v", action, uid, actorID)
+}
+
+func newPurgeConfirmComponent(m *module) *bot.ModuleMessageComponent {
+	run := func(d *discord.DiscordMessageComponent) {
+		parts := strings.Split(d.Data.CustomID, ":")
+		if len(parts) != 4 {
+			return
+		}
+		action, uid, actorID := parts[1], parts[2], parts[3]
+
+		// components don't check permissions, so only the user who ran the
+		// command may confirm it
+		if d.AuthorID() != actorID {
+			d.RespondEphemeral("Only the user who asked for the purge can confirm it")
+			return
+		}
+
+		if action != "confirm" {
+			resp := &discordgo.InteractionResponseData{
+				Content:    "Purge cancelled",
+				Embeds:     []*discordgo.MessageEmbed{},
+				Components: []discordgo.MessageComponent{},
+			}
+			d.RespondComplex(resp, discordgo.InteractionResponseUpdateMessage)
+			return
+		}
+
+		// purging can take longer than an interaction may go unanswered
+		if err := d.RespondComplex(nil, discordgo.InteractionResponseDeferredMessageUpdate); err != nil {
+			m.Logger.Error("failed to defer purge response", zap.Error(err))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(m.ctx, purgeTimeout)
+		defer cancel()
+
+		text := ""
+		result, err := m.store.PurgeUser(ctx, d.GuildID(), uid)
+		if err != nil {
+			m.Logger.Error("failed to purge user", zap.String("user", uid), zap.Error(err))
+			text = "Failed to purge all data, some of it may have been deleted"
+		}
+
+		audit := &PurgeAudit{
+			GuildID:   d.GuildID(),
+			UserID:    uid,
+			ActorID:   actorID,
+			CreatedAt: time.Now(),
+		}
+		if err := m.db.CreatePurgeAudit(ctx, audit); err != nil {
+			m.Logger.Error("failed to create purge audit", zap.Error(err))
+		}
+
+		embeds := []*discordgo.MessageEmbed{}
+		if result != nil {
+			embeds = append(embeds, generatePurgeResultEmbed(uid, result))
+		}
+		components := []discordgo.MessageComponent{}
+		_, err = d.Sess.Real().InteractionResponseEdit(d.Interaction, &discordgo.WebhookEdit{
+			Content:    &text,
+			Embeds:     &embeds,
+			Components: &components,
+		})
+		if err != nil {
+			m.Logger.Error("failed to respond to purge", zap.Error(err))
+		}
+	}
+
+	return &bot.ModuleMessageComponent{
+		Mod:     m,
+		Name:    "privacy_purge",
+		Enabled: true,
+		Execute: run,
+	}
+}
+
+func generatePurgeResultEmbed(uid string, result *PurgeResult) *discordgo.MessageEmbed {
+	return builders.NewEmbedBuilder().
+		WithTitle("Purged user data").
+		WithOkColor().
+		WithDescription(fmt.Sprintf("The data of <@%v> was deleted", uid)).
+		AddField("Messages", fmt.Sprint(result.Messages), true).
+		AddField("Attachments", fmt.Sprint(result.Attachments), true).
+		AddField("Member records", fmt.Sprint(result.MemberRecords), true).
+		WithFooter("The purge is recorded in /privacy log", "").
+		Build()
+}
@@ -0,0 +1,90 @@
+package stare
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync/atomic"
+)
+
+// Compressed values start with compressedMagic followed by the DEFLATE
+// compressed data. Values that don't start with it are stored as they are,
+// which includes everything written before compression was added.
+const compressedMagic byte = 0xb1
+
+// minCompressSize is the size below which values aren't worth compressing.
+const minCompressSize = 64
+
+// compress compresses data, or returns it as is if compressing doesn't make
+// it smaller.
+func compress(data []byte) []byte {
+	if len(data) < minCompressSize {
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(compressedMagic)
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	if _, err := w.Write(data); err != nil {
+		return data
+	}
+	if err := w.Close(); err != nil {
+		return data
+	}
+
+	if buf.Len() >= len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// decompress reverses compress.
+func decompress(data []byte) ([]byte, error) {
+	if !isCompressed(data) {
+		return data, nil
+	}
+	r := flate.NewReader(bytes.NewReader(data[1:]))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func isCompressed(data []byte) bool {
+	return len(data) > 0 && data[0] == compressedMagic
+}
+
+// CompressionStats sums up the size of values before and after compression.
+type CompressionStats struct {
+	RawBytes    uint64
+	StoredBytes uint64
+}
+
+// Ratio returns how many times smaller values are when stored.
+func (c CompressionStats) Ratio() float64 {
+	if c.StoredBytes == 0 {
+		return 1
+	}
+	return float64(c.RawBytes) / float64(c.StoredBytes)
+}
+
+func (c *CompressionStats) add(raw, stored int) {
+	c.RawBytes += uint64(raw)
+	c.StoredBytes += uint64(stored)
+}
+
+// compressionCounter counts the bytes written through compress.
+type compressionCounter struct {
+	raw    atomic.Uint64
+	stored atomic.Uint64
+}
+
+func (c *compressionCounter) add(raw, stored int) {
+	c.raw.Add(uint64(raw))
+	c.stored.Add(uint64(stored))
+}
+
+func (c *compressionCounter) stats() CompressionStats {
+	return CompressionStats{
+		RawBytes:    c.raw.Load(),
+		StoredBytes: c.stored.Load(),
+	}
+}
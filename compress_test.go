@@ -0,0 +1,114 @@
+package stare
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	random := make([]byte, 1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		data           []byte
+		wantCompressed bool
+	}{
+		{"empty", []byte{}, false},
+		{"below min size", bytes.Repeat([]byte("a"), minCompressSize-1), false},
+		{"compressible", bytes.Repeat([]byte("hello "), 100), true},
+		{"incompressible", random, false},
+		{"record", []byte{recordMagic, recordVersion}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := compress(tt.data)
+			if got := isCompressed(stored); got != tt.wantCompressed {
+				t.Fatalf("compressed = %v, want %v", got, tt.wantCompressed)
+			}
+			if tt.wantCompressed && len(stored) >= len(tt.data) {
+				t.Errorf("compressed to %v bytes from %v", len(stored), len(tt.data))
+			}
+			if !tt.wantCompressed && !bytes.Equal(stored, tt.data) {
+				t.Errorf("uncompressed data was changed")
+			}
+
+			got, err := decompress(stored)
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("decompress = %q, want %q", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestDecompressBlob(t *testing.T) {
+	hash := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	text := bytes.Repeat([]byte("attachment "), 100)
+	// an attachment stored before compression that starts with the
+	// compression header by chance
+	legacy := append([]byte{compressedMagic}, text...)
+
+	tests := []struct {
+		name string
+		hash string
+		data []byte
+		want []byte
+	}{
+		{"compressed", hash(text), compress(text), text},
+		{"stored as is", hash(text[:10]), text[:10], text[:10]},
+		{"legacy with header", hash(legacy), legacy, legacy},
+		{"compressed but other hash", hash([]byte("other")), compress(text), compress(text)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decompressBlob(tt.hash, tt.data); !bytes.Equal(got, tt.want) {
+				t.Errorf("decompressBlob = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlobStoreRoundTrip(t *testing.T) {
+	keyring, err := NewKeyring([][]byte{bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := NewBlobStore(t.TempDir(), keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{[]byte("small"), bytes.Repeat([]byte("large "), 1000)} {
+		hash, err := blobs.Put(data)
+		if err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		again, err := blobs.Put(data)
+		if err != nil || again != hash {
+			t.Fatalf("Put of the same data = %v, %v, want %v", again, err, hash)
+		}
+
+		got, err := blobs.Get(hash)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Get = %v bytes, want %v", len(got), len(data))
+		}
+		size, _, err := blobs.Stat(hash)
+		if err != nil || size != len(data) {
+			t.Errorf("Stat = %v, %v, want size %v", size, err, len(data))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package stare
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/intrntsrfr/meido/pkg/utils"
+)
+
+// fileConfig is the layout of config.json.
+type fileConfig struct {
+	Token            string   `json:"token"`
+	Shards           int      `json:"shards"`
+	OwnerIDs         []string `json:"owner_ids"`
+	Database         string   `json:"database"`
+	ConnectionString string   `json:"connection_string"`
+	SQLitePath       string   `json:"sqlite_path"`
+	JsonBackups      *int     `json:"json_backups"`
+	GuildCacheSize   int      `json:"guild_cache_size"`
+	Store            string   `json:"store"`
+	DataDir          string   `json:"data_dir"`
+	AttachmentDir    string   `json:"attachment_dir"`
+	MessageTTL       string   `json:"message_ttl"`
+	MemberHistoryTTL string   `json:"member_history_ttl"`
+	GCInterval       string   `json:"gc_interval"`
+	GCDiscardRatio   float64  `json:"gc_discard_ratio"`
+	EncryptionKeys   []string `json:"encryption_keys"`
+	GuildMaxMessages int      `json:"guild_max_messages"`
+	GuildMaxBytes    int      `json:"guild_max_bytes"`
+
+	FetchWorkers          int    `json:"fetch_workers"`
+	FetchQueueSize        int    `json:"fetch_queue_size"`
+	FetchTimeout          string `json:"fetch_timeout"`
+	FetchRetries          *int   `json:"fetch_retries"`
+	GuildAttachmentBudget int    `json:"guild_attachment_budget"`
+}
+
+// LoadConfig reads the JSON config file at path into cfg.
+func LoadConfig(cfg *utils.Config, path string) error {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var c fileConfig
+	if err := json.Unmarshal(f, &c); err != nil {
+		return err
+	}
+
+	cfg.Set("token", c.Token)
+	cfg.Set("shards", c.Shards)
+	cfg.Set("owner_ids", c.OwnerIDs)
+	cfg.Set("database", c.Database)
+	cfg.Set("connection_string", c.ConnectionString)
+	cfg.Set("sqlite_path", c.SQLitePath)
+	cfg.Set("guild_cache_size", c.GuildCacheSize)
+	cfg.Set("store", c.Store)
+	cfg.Set("data_dir", c.DataDir)
+	cfg.Set("attachment_dir", c.AttachmentDir)
+	cfg.Set("message_ttl", c.MessageTTL)
+	cfg.Set("member_history_ttl", c.MemberHistoryTTL)
+	cfg.Set("gc_interval", c.GCInterval)
+	if c.GCDiscardRatio != 0 {
+		cfg.Set("gc_discard_ratio", strconv.FormatFloat(c.GCDiscardRatio, 'f', -1, 64))
+	}
+	cfg.Set("encryption_keys", c.EncryptionKeys)
+	cfg.Set("guild_max_messages", c.GuildMaxMessages)
+	cfg.Set("guild_max_bytes", c.GuildMaxBytes)
+	cfg.Set("fetch_workers", c.FetchWorkers)
+	cfg.Set("fetch_queue_size", c.FetchQueueSize)
+	cfg.Set("fetch_timeout", c.FetchTimeout)
+	if c.FetchRetries != nil {
+		cfg.Set("fetch_retries", *c.FetchRetries)
+	}
+	cfg.Set("guild_attachment_budget", c.GuildAttachmentBudget)
+	cfg.Set("json_backups", DefaultJsonBackups)
+	if c.JsonBackups != nil {
+		cfg.Set("json_backups", *c.JsonBackups)
+	}
+	return nil
+}
+
+// OpenDatabase opens the database selected by the database setting in cfg.
+func OpenDatabase(cfg *utils.Config) (DB, error) {
+	switch cfg.GetString("database") {
+	case "postgres":
+		return NewPostgresDatabase(cfg.GetString("connection_string"))
+	case "sqlite":
+		return NewSQLiteDatabase(cfg.GetString("sqlite_path"))
+	case "json", "":
+		return NewJsonDatabase("./data.json", cfg.GetInt("json_backups"))
+	default:
+		return nil, fmt.Errorf("unknown database type: %v", cfg.GetString("database"))
+	}
+}
@@ -1,10 +1,14 @@
 package stare
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
@@ -14,95 +18,254 @@ type DB interface {
 	GetConn() *sqlx.DB
 	Close() error
 
-	CreateGuild(gid string) error
-	UpdateGuild(gid string, gc *Guild) error
-	GetGuild(gid string) (*Guild, error)
+	CreateGuild(ctx context.Context, gid string) error
+	UpdateGuild(ctx context.Context, gid string, gc *Guild) error
+	GetGuild(ctx context.Context, gid string) (*Guild, error)
+	GetGuilds(ctx context.Context) ([]*Guild, error)
+
+	// UpdateGuildSettings updates a guild and records revs as its revisions
+	// together, so a change is never stored without its revision.
+	UpdateGuildSettings(ctx context.Context, gid string, gc *Guild, revs []*GuildRevision) error
+	CreateGuildRevision(ctx context.Context, rev *GuildRevision) error
+	GetGuildRevisions(ctx context.Context, gid string) ([]*GuildRevision, error)
+
+	CreatePurgeAudit(ctx context.Context, audit *PurgeAudit) error
+	GetPurgeAudits(ctx context.Context, gid string) ([]*PurgeAudit, error)
 }
 
+// ErrGuildNotFound is returned by every DB when a guild is not stored.
+var ErrGuildNotFound = errors.New("guild not found")
+
+// errReadOnly is returned when a read only JsonDB is changed.
+var errReadOnly = errors.New("database is read only")
+
 type Config struct {
 	Log     *zap.Logger
 	ConnStr string
 }
 
 type Guild struct {
-	ID           string `json:"id" db:"id"`
-	MsgEditLog   string `json:"msg_edit_log" db:"msg_edit_log"`
-	MsgDeleteLog string `json:"msg_delete_log" db:"msg_delete_log"`
-	BanLog       string `json:"ban_log" db:"ban_log"`
-	UnbanLog     string `json:"unban_log" db:"unban_log"`
-	JoinLog      string `json:"join_log" db:"join_log"`
-	LeaveLog     string `json:"leave_log" db:"leave_log"`
+	ID               string `json:"id" db:"id"`
+	MsgEditLog       string `json:"msg_edit_log" db:"msg_edit_log"`
+	MsgDeleteLog     string `json:"msg_delete_log" db:"msg_delete_log"`
+	BanLog           string `json:"ban_log" db:"ban_log"`
+	UnbanLog         string `json:"unban_log" db:"unban_log"`
+	JoinLog          string `json:"join_log" db:"join_log"`
+	LeaveLog         string `json:"leave_log" db:"leave_log"`
+	MemberUpdateLog  string `json:"member_update_log" db:"member_update_log"`
+	ChannelLog       string `json:"channel_log" db:"channel_log"`
+	RoleLog          string `json:"role_log" db:"role_log"`
+	VoiceLog         string `json:"voice_log" db:"voice_log"`
+	MessageRetention int    `json:"message_retention" db:"message_retention"` // hours, 0 uses the bot default
+}
+
+// GuildRevision is a single change made to a guild's settings.
+type GuildRevision struct {
+	GuildID   string    `json:"guild_id" db:"guild_id"`
+	Revision  int       `json:"revision" db:"revision"`
+	ActorID   string    `json:"actor_id" db:"actor_id"`
+	Field     string    `json:"field" db:"field"`
+	OldValue  string    `json:"old_value" db:"old_value"`
+	NewValue  string    `json:"new_value" db:"new_value"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// PurgeAudit records that the stored data of a user in a guild was purged,
+// and who did it.
+type PurgeAudit struct {
+	GuildID   string    `json:"guild_id" db:"guild_id"`
+	UserID    string    `json:"user_id" db:"user_id"`
+	ActorID   string    `json:"actor_id" db:"actor_id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
 
 //
 // JSON implementation DB
 //
 
+// DefaultJsonBackups is the number of backups kept by a JsonDB when nothing
+// else is configured.
+const DefaultJsonBackups = 3
+
 type JsonDB struct {
-	path  string
-	state *state
+	path     string
+	backups  int
+	readOnly bool
+	state    *state
 }
 
 type state struct {
 	sync.Mutex
-	Guilds map[string]*Guild `json:"guilds"`
+	Guilds      map[string]*Guild           `json:"guilds"`
+	Revisions   map[string][]*GuildRevision `json:"revisions"`
+	PurgeAudits map[string][]*PurgeAudit    `json:"purge_audits"`
 }
 
-func NewJsonDatabase(path string) (*JsonDB, error) {
+// NewJsonDatabase opens the JSON database at path. Every mutation is written
+// to disk, and the previous backups versions of the file are kept around as
+// path.1 (newest) to path.N (oldest) in case the current one gets corrupted.
+func NewJsonDatabase(path string, backups int) (*JsonDB, error) {
+	if backups < 0 {
+		backups = 0
+	}
 	db := &JsonDB{
-		path: path,
+		path:    path,
+		backups: backups,
 		state: &state{
-			Guilds: make(map[string]*Guild, 0),
+			Guilds:      make(map[string]*Guild, 0),
+			Revisions:   make(map[string][]*GuildRevision, 0),
+			PurgeAudits: make(map[string][]*PurgeAudit, 0),
 		},
 	}
-	err := db.load(path)
+	err := db.load()
 	return db, err
 }
 
+// NewJsonDatabaseReadOnly opens the JSON database at path without ever
+// writing to it, falling back to its backups like NewJsonDatabase does. A
+// database that doesn't exist yet is opened empty.
+func NewJsonDatabaseReadOnly(path string, backups int) (*JsonDB, error) {
+	db, err := NewJsonDatabase(path, backups)
+	if err != nil {
+		return nil, err
+	}
+	db.readOnly = true
+	return db, nil
+}
+
 func (j *JsonDB) Close() error {
+	if j.readOnly {
+		return nil
+	}
+	j.state.Lock()
+	defer j.state.Unlock()
 	return j.save()
 }
 
-func (j *JsonDB) load(path string) error {
-	if _, err := os.Stat(path); err != nil {
+// load reads the newest file that contains valid JSON, starting with the
+// database itself and falling back to its backups.
+func (j *JsonDB) load() error {
+	var firstErr error
+	for _, path := range j.files() {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		state, err := readState(path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to read %v: %w", path, err)
+			}
+			continue
+		}
+
+		j.state = state
 		return nil
 	}
+	return firstErr
+}
 
+func readState(path string) (*state, error) {
 	d, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	state := &state{}
-	err = json.Unmarshal(d, &state)
-	if err != nil {
-		return err
+	if err := json.Unmarshal(d, &state); err != nil {
+		return nil, err
+	}
+	if state.Guilds == nil {
+		state.Guilds = make(map[string]*Guild)
+	}
+	if state.Revisions == nil {
+		state.Revisions = make(map[string][]*GuildRevision)
 	}
+	if state.PurgeAudits == nil {
+		state.PurgeAudits = make(map[string][]*PurgeAudit)
+	}
+	return state, nil
+}
 
-	j.state = state
-	return nil
+// files returns the database path followed by its backups, newest first.
+func (j *JsonDB) files() []string {
+	files := []string{j.path}
+	for i := 1; i <= j.backups; i++ {
+		files = append(files, fmt.Sprintf("%v.%v", j.path, i))
+	}
+	return files
 }
 
+// save writes the state to a temporary file and renames it over the database
+// so the file on disk is never half written. The state lock must be held.
 func (j *JsonDB) save() error {
+	if j.readOnly {
+		return errReadOnly
+	}
 	d, err := json.Marshal(j.state)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = f.Write(d)
-	return err
+	if _, err := f.Write(d); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := j.rotate(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// jsonBackupInterval is how long the newest backup of a JsonDB is kept
+// before the next change rotates the backups. Rotating on every change would
+// let a burst of changes replace every backup within seconds.
+const jsonBackupInterval = time.Hour
+
+// rotate shifts every backup one step older, dropping the oldest one, and
+// moves the current database into the newest backup slot. Nothing is rotated
+// if the newest backup is younger than jsonBackupInterval.
+func (j *JsonDB) rotate() error {
+	if j.backups == 0 {
+		return nil
+	}
+
+	files := j.files()
+	if info, err := os.Stat(files[1]); err == nil && time.Since(info.ModTime()) < jsonBackupInterval {
+		return nil
+	}
+	for i := len(files) - 1; i > 0; i-- {
+		if _, err := os.Stat(files[i-1]); err != nil {
+			continue
+		}
+		if err := os.Rename(files[i-1], files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (j *JsonDB) GetConn() *sqlx.DB {
 	return nil
 }
 
-func (j *JsonDB) CreateGuild(gid string) error {
+func (j *JsonDB) CreateGuild(ctx context.Context, gid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	j.state.Lock()
 	defer j.state.Unlock()
 	if _, ok := j.state.Guilds[gid]; ok {
@@ -110,24 +273,129 @@ func (j *JsonDB) CreateGuild(gid string) error {
 	}
 	g := &Guild{ID: gid}
 	j.state.Guilds[gid] = g
-	return nil
+	return j.save()
 }
 
-func (j *JsonDB) UpdateGuild(gid string, gc *Guild) error {
+func (j *JsonDB) UpdateGuild(ctx context.Context, gid string, gc *Guild) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	j.state.Lock()
 	defer j.state.Unlock()
 	if _, ok := j.state.Guilds[gid]; !ok {
-		return errors.New("key does not exist")
+		return ErrGuildNotFound
 	}
-	j.state.Guilds[gid] = gc
-	return nil
+	g := *gc
+	j.state.Guilds[gid] = &g
+	return j.save()
 }
 
-func (j *JsonDB) GetGuild(gid string) (*Guild, error) {
+func (j *JsonDB) GetGuild(ctx context.Context, gid string) (*Guild, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	j.state.Lock()
 	defer j.state.Unlock()
 	if v, ok := j.state.Guilds[gid]; ok {
-		return v, nil
+		g := *v
+		return &g, nil
+	}
+	return nil, ErrGuildNotFound
+}
+
+func (j *JsonDB) GetGuilds(ctx context.Context) ([]*Guild, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	j.state.Lock()
+	defer j.state.Unlock()
+	guilds := make([]*Guild, 0, len(j.state.Guilds))
+	for _, v := range j.state.Guilds {
+		g := *v
+		guilds = append(guilds, &g)
+	}
+	sort.Slice(guilds, func(i, k int) bool {
+		return guilds[i].ID < guilds[k].ID
+	})
+	return guilds, nil
+}
+
+func (j *JsonDB) UpdateGuildSettings(ctx context.Context, gid string, gc *Guild, revs []*GuildRevision) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.Guilds[gid]; !ok {
+		return ErrGuildNotFound
+	}
+	g := *gc
+	j.state.Guilds[gid] = &g
+	for _, rev := range revs {
+		j.addRevision(rev)
+	}
+	return j.save()
+}
+
+func (j *JsonDB) CreateGuildRevision(ctx context.Context, rev *GuildRevision) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.Guilds[rev.GuildID]; !ok {
+		return ErrGuildNotFound
+	}
+	j.addRevision(rev)
+	return j.save()
+}
+
+// addRevision numbers rev and appends it to the revisions of its guild. The
+// state lock must be held.
+func (j *JsonDB) addRevision(rev *GuildRevision) {
+	revisions := j.state.Revisions[rev.GuildID]
+	rev.Revision = len(revisions) + 1
+	r := *rev
+	j.state.Revisions[rev.GuildID] = append(revisions, &r)
+}
+
+func (j *JsonDB) GetGuildRevisions(ctx context.Context, gid string) ([]*GuildRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	j.state.Lock()
+	defer j.state.Unlock()
+	revisions := j.state.Revisions[gid]
+	res := make([]*GuildRevision, 0, len(revisions))
+	for i := len(revisions) - 1; i >= 0; i-- {
+		r := *revisions[i]
+		res = append(res, &r)
+	}
+	return res, nil
+}
+
+func (j *JsonDB) CreatePurgeAudit(ctx context.Context, audit *PurgeAudit) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	j.state.Lock()
+	defer j.state.Unlock()
+	a := *audit
+	j.state.PurgeAudits[audit.GuildID] = append(j.state.PurgeAudits[audit.GuildID], &a)
+	return j.save()
+}
+
+func (j *JsonDB) GetPurgeAudits(ctx context.Context, gid string) ([]*PurgeAudit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	j.state.Lock()
+	defer j.state.Unlock()
+	audits := j.state.PurgeAudits[gid]
+	res := make([]*PurgeAudit, 0, len(audits))
+	for i := len(audits) - 1; i >= 0; i-- {
+		a := *audits[i]
+		res = append(res, &a)
 	}
-	return nil, errors.New("key does not exist")
+	return res, nil
 }
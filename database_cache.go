@@ -0,0 +1,125 @@
+package stare
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+//
+// Cached DB
+//
+
+// CachedDB keeps the most recently used guilds from another DB in memory, so
+// event handlers do not hit the database on every event. Guilds are evicted
+// least recently used first once the cache holds size guilds.
+type CachedDB struct {
+	DB
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	// generation is bumped on every invalidation, so a lookup that raced with
+	// an update does not put a stale guild back into the cache
+	generation uint64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+func NewCachedDB(db DB, size int) *CachedDB {
+	return &CachedDB{
+		DB:      db,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *CachedDB) CreateGuild(ctx context.Context, gid string) error {
+	defer c.invalidate(gid)
+	return c.DB.CreateGuild(ctx, gid)
+}
+
+func (c *CachedDB) UpdateGuild(ctx context.Context, gid string, gc *Guild) error {
+	defer c.invalidate(gid)
+	return c.DB.UpdateGuild(ctx, gid, gc)
+}
+
+func (c *CachedDB) UpdateGuildSettings(ctx context.Context, gid string, gc *Guild, revs []*GuildRevision) error {
+	defer c.invalidate(gid)
+	return c.DB.UpdateGuildSettings(ctx, gid, gc, revs)
+}
+
+func (c *CachedDB) GetGuild(ctx context.Context, gid string) (*Guild, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[gid]; ok {
+		c.order.MoveToFront(e)
+		g := *e.Value.(*Guild)
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return &g, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	gc, err := c.DB.GetGuild(ctx, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation == c.generation {
+		c.add(gc)
+	}
+	g := *gc
+	return &g, nil
+}
+
+// add inserts a copy of gc into the cache. The lock must be held.
+func (c *CachedDB) add(gc *Guild) {
+	if _, ok := c.entries[gc.ID]; ok {
+		return
+	}
+	g := *gc
+	c.entries[gc.ID] = c.order.PushFront(&g)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*Guild).ID)
+	}
+}
+
+func (c *CachedDB) invalidate(gid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if e, ok := c.entries[gid]; ok {
+		c.order.Remove(e)
+		delete(c.entries, gid)
+	}
+}
+
+// Stats returns the number of cache hits and misses since the cache was
+// created, along with the number of cached guilds.
+func (c *CachedDB) Stats() CacheStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   size,
+	}
+}
@@ -0,0 +1,31 @@
+package stare
+
+import (
+	_ "github.com/lib/pq"
+)
+
+//
+// PostgreSQL implementation DB
+//
+
+type PostgresDB struct {
+	*sqlDB
+}
+
+func NewPostgresDatabase(connStr string) (*PostgresDB, error) {
+	db, err := newSqlDB("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresDB{db}, nil
+}
+
+// NewPostgresDatabaseReadOnly connects to a PostgreSQL database without
+// migrating it, for callers that only read from it.
+func NewPostgresDatabaseReadOnly(connStr string) (*PostgresDB, error) {
+	db, err := connectSqlDB("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresDB{db}, nil
+}
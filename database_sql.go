@@ -0,0 +1,188 @@
+package stare
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sqlDB implements DB on top of any SQL database supported by sqlx. Queries
+// are written with ? placeholders and rebound for the driver in use, so every
+// SQL backend shares the same queries and migrations.
+type sqlDB struct {
+	pool *sqlx.DB
+	// version is the newest migration applied to the database
+	version int
+}
+
+func newSqlDB(driver, dataSource string) (*sqlDB, error) {
+	pool, err := sqlx.Connect(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return openSqlDB(pool)
+}
+
+// connectSqlDB connects to the database without migrating it, for callers
+// that only read from it. Tables added by migrations the database doesn't
+// have yet are read as empty.
+func connectSqlDB(driver, dataSource string) (*sqlDB, error) {
+	pool, err := sqlx.Connect(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	return openSqlDB(pool)
+}
+
+func openSqlDB(pool *sqlx.DB) (*sqlDB, error) {
+	version, err := schemaVersion(pool)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return &sqlDB{pool: pool, version: version}, nil
+}
+
+func (s *sqlDB) Close() error {
+	return s.pool.Close()
+}
+
+func (s *sqlDB) GetConn() *sqlx.DB {
+	return s.pool
+}
+
+func (s *sqlDB) CreateGuild(ctx context.Context, gid string) error {
+	_, err := s.pool.ExecContext(ctx, s.pool.Rebind("INSERT INTO guild(id) VALUES(?)"), gid)
+	return err
+}
+
+func (s *sqlDB) UpdateGuild(ctx context.Context, gid string, gc *Guild) error {
+	return updateGuild(ctx, s.pool, gid, gc)
+}
+
+func updateGuild(ctx context.Context, db sqlx.ExtContext, gid string, gc *Guild) error {
+	res, err := db.ExecContext(ctx, db.Rebind(`UPDATE guild SET msg_edit_log=?, msg_delete_log=?, ban_log=?, unban_log=?, join_log=?, leave_log=?, member_update_log=?, channel_log=?, role_log=?, voice_log=?, message_retention=? WHERE id=?`),
+		gc.MsgEditLog, gc.MsgDeleteLog, gc.BanLog, gc.UnbanLog, gc.JoinLog, gc.LeaveLog, gc.MemberUpdateLog, gc.ChannelLog, gc.RoleLog, gc.VoiceLog,
+		gc.MessageRetention, gid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrGuildNotFound
+	}
+	return nil
+}
+
+func (s *sqlDB) GetGuild(ctx context.Context, gid string) (*Guild, error) {
+	var guild Guild
+	err := s.pool.GetContext(ctx, &guild, s.pool.Rebind("SELECT * FROM guild WHERE id=?"), gid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrGuildNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &guild, nil
+}
+
+func (s *sqlDB) GetGuilds(ctx context.Context) ([]*Guild, error) {
+	var guilds []*Guild
+	err := s.pool.SelectContext(ctx, &guilds, "SELECT * FROM guild ORDER BY id")
+	return guilds, err
+}
+
+func (s *sqlDB) UpdateGuildSettings(ctx context.Context, gid string, gc *Guild, revs []*GuildRevision) error {
+	tx, err := s.pool.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateGuild(ctx, tx, gid, gc); err != nil {
+		return err
+	}
+	numbers := make([]int, len(revs))
+	for i, rev := range revs {
+		if numbers[i], err = createGuildRevision(ctx, tx, rev); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i, rev := range revs {
+		rev.Revision = numbers[i]
+	}
+	return nil
+}
+
+func (s *sqlDB) CreateGuildRevision(ctx context.Context, rev *GuildRevision) error {
+	tx, err := s.pool.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	revision, err := createGuildRevision(ctx, tx, rev)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rev.Revision = revision
+	return nil
+}
+
+// createGuildRevision inserts rev as the next revision of its guild and
+// returns its number.
+func createGuildRevision(ctx context.Context, tx *sqlx.Tx, rev *GuildRevision) (int, error) {
+	var revision int
+	err := tx.GetContext(ctx, &revision, tx.Rebind("SELECT COALESCE(MAX(revision), 0) + 1 FROM guild_revision WHERE guild_id=?"), rev.GuildID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, tx.Rebind("INSERT INTO guild_revision(guild_id, revision, actor_id, field, old_value, new_value, created_at) VALUES(?, ?, ?, ?, ?, ?, ?)"),
+		rev.GuildID, revision, rev.ActorID, rev.Field, rev.OldValue, rev.NewValue, rev.CreatedAt.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return revision, nil
+}
+
+func (s *sqlDB) GetGuildRevisions(ctx context.Context, gid string) ([]*GuildRevision, error) {
+	if s.version < guildRevisionMigration {
+		return nil, nil
+	}
+	var revisions []*GuildRevision
+	err := s.pool.SelectContext(ctx, &revisions, s.pool.Rebind("SELECT * FROM guild_revision WHERE guild_id=? ORDER BY revision DESC"), gid)
+	return revisions, err
+}
+
+func (s *sqlDB) CreatePurgeAudit(ctx context.Context, audit *PurgeAudit) error {
+	_, err := s.pool.ExecContext(ctx, s.pool.Rebind("INSERT INTO purge_audit(guild_id, user_id, actor_id, created_at) VALUES(?, ?, ?, ?)"),
+		audit.GuildID, audit.UserID, audit.ActorID, audit.CreatedAt.UTC())
+	return err
+}
+
+func (s *sqlDB) GetPurgeAudits(ctx context.Context, gid string) ([]*PurgeAudit, error) {
+	if s.version < purgeAuditMigration {
+		return nil, nil
+	}
+	var audits []*PurgeAudit
+	err := s.pool.SelectContext(ctx, &audits, s.pool.Rebind("SELECT * FROM purge_audit WHERE guild_id=? ORDER BY created_at DESC"), gid)
+	return audits, err
+}
@@ -0,0 +1,37 @@
+package stare
+
+import (
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//
+// SQLite implementation DB
+//
+
+type SQLiteDB struct {
+	*sqlDB
+}
+
+func NewSQLiteDatabase(path string) (*SQLiteDB, error) {
+	dsn := fmt.Sprintf("file:%v?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on", path)
+	db, err := newSqlDB("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows a single writer at a time
+	db.pool.SetMaxOpenConns(1)
+	return &SQLiteDB{db}, nil
+}
+
+// NewSQLiteDatabaseReadOnly opens an existing SQLite database read only. It
+// isn't migrated, so guilds are read with the columns the database has.
+func NewSQLiteDatabaseReadOnly(path string) (*SQLiteDB, error) {
+	dsn := fmt.Sprintf("file:%v?mode=ro&_busy_timeout=5000", path)
+	db, err := connectSqlDB("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteDB{db}, nil
+}
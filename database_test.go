@@ -0,0 +1,240 @@
+package stare
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// testDatabases are the DB implementations every database test is run
+// against.
+var testDatabases = []struct {
+	name string
+	open func(t *testing.T) DB
+}{
+	{"json", func(t *testing.T) DB {
+		db, err := NewJsonDatabase(filepath.Join(t.TempDir(), "data.json"), DefaultJsonBackups)
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		return db
+	}},
+	{"sqlite", func(t *testing.T) DB {
+		db, err := NewSQLiteDatabase(filepath.Join(t.TempDir(), "data.db"))
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		return db
+	}},
+}
+
+// forEachDB runs test against every DB implementation, each with its own
+// empty database.
+func forEachDB(t *testing.T, test func(t *testing.T, db DB)) {
+	for _, td := range testDatabases {
+		t.Run(td.name, func(t *testing.T) {
+			db := td.open(t)
+			t.Cleanup(func() { db.Close() })
+			test(t, db)
+		})
+	}
+}
+
+func TestDBUpdateGuildSettings(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db DB) {
+		ctx := context.Background()
+		if err := db.CreateGuild(ctx, "1"); err != nil {
+			t.Fatalf("CreateGuild: %v", err)
+		}
+
+		gc := &Guild{ID: "1", BanLog: "2", JoinLog: "3"}
+		revs := []*GuildRevision{
+			{GuildID: "1", ActorID: "9", Field: "ban_log", NewValue: "2", CreatedAt: time.Now()},
+			{GuildID: "1", ActorID: "9", Field: "join_log", NewValue: "3", CreatedAt: time.Now()},
+		}
+		if err := db.UpdateGuildSettings(ctx, "1", gc, revs); err != nil {
+			t.Fatalf("UpdateGuildSettings: %v", err)
+		}
+		if revs[0].Revision != 1 || revs[1].Revision != 2 {
+			t.Errorf("revisions numbered %v and %v, want 1 and 2", revs[0].Revision, revs[1].Revision)
+		}
+
+		got, err := db.GetGuild(ctx, "1")
+		if err != nil {
+			t.Fatalf("GetGuild: %v", err)
+		}
+		if *got != *gc {
+			t.Errorf("GetGuild = %+v, want %+v", got, gc)
+		}
+		stored, err := db.GetGuildRevisions(ctx, "1")
+		if err != nil {
+			t.Fatalf("GetGuildRevisions: %v", err)
+		}
+		if len(stored) != 2 || stored[0].Field != "join_log" || stored[1].Field != "ban_log" {
+			t.Errorf("GetGuildRevisions = %+v, want the join log and ban log revisions", stored)
+		}
+
+		// the revisions aren't recorded for a guild that can't be updated
+		missing := []*GuildRevision{{GuildID: "5", Field: "ban_log", NewValue: "2", CreatedAt: time.Now()}}
+		if err := db.UpdateGuildSettings(ctx, "5", &Guild{ID: "5"}, missing); err == nil {
+			t.Error("UpdateGuildSettings of a missing guild succeeded")
+		}
+		if stored, _ := db.GetGuildRevisions(ctx, "5"); len(stored) != 0 {
+			t.Errorf("revisions of a missing guild = %+v, want none", stored)
+		}
+	})
+}
+
+func TestDBGuildNotFound(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db DB) {
+		ctx := context.Background()
+		tests := []struct {
+			name string
+			fn   func() error
+		}{
+			{"GetGuild", func() error {
+				_, err := db.GetGuild(ctx, "1")
+				return err
+			}},
+			{"UpdateGuild", func() error {
+				return db.UpdateGuild(ctx, "1", &Guild{ID: "1"})
+			}},
+			{"UpdateGuildSettings", func() error {
+				return db.UpdateGuildSettings(ctx, "1", &Guild{ID: "1"}, nil)
+			}},
+		}
+		for _, tt := range tests {
+			if err := tt.fn(); !errors.Is(err, ErrGuildNotFound) {
+				t.Errorf("%v: got %v, want ErrGuildNotFound", tt.name, err)
+			}
+		}
+	})
+}
+
+// A database that is only read isn't migrated, so the tables of later
+// migrations are read as empty.
+func TestSQLiteReadOnlyOldSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	pool, err := sqlx.Connect("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.Exec(`create table schema_migrations
+(
+    version    integer   not null primary key,
+    name       text      not null,
+    applied_at timestamp not null
+);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyMigration(pool, migrations[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec("INSERT INTO guild(id) VALUES('1')"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Close()
+
+	db, err := NewSQLiteDatabaseReadOnly(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteDatabaseReadOnly: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	guilds, err := db.GetGuilds(ctx)
+	if err != nil || len(guilds) != 1 {
+		t.Errorf("GetGuilds = %v, %v, want guild 1", guilds, err)
+	}
+	if revisions, err := db.GetGuildRevisions(ctx, "1"); err != nil || len(revisions) != 0 {
+		t.Errorf("GetGuildRevisions = %v, %v, want none", revisions, err)
+	}
+	if audits, err := db.GetPurgeAudits(ctx, "1"); err != nil || len(audits) != 0 {
+		t.Errorf("GetPurgeAudits = %v, %v, want none", audits, err)
+	}
+}
+
+func TestJsonReadOnlyBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	if err := os.WriteFile(path, []byte("{corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".1", []byte(`{"guilds":{"1":{"id":"1"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewJsonDatabaseReadOnly(path, 1)
+	if err != nil {
+		t.Fatalf("NewJsonDatabaseReadOnly: %v", err)
+	}
+	if _, err := db.GetGuild(context.Background(), "1"); err != nil {
+		t.Errorf("GetGuild from the backup: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "{corrupt" {
+		t.Errorf("read only database was written: %s", data)
+	}
+}
+
+func TestJsonBackupRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	db, err := NewJsonDatabase(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	// guilds returns the guilds stored in a backup, or -1 if it doesn't exist
+	guilds := func(file string) int {
+		state, err := readState(file)
+		if err != nil {
+			return -1
+		}
+		return len(state.Guilds)
+	}
+	create := func(gid string) {
+		if err := db.CreateGuild(ctx, gid); err != nil {
+			t.Fatalf("CreateGuild: %v", err)
+		}
+	}
+
+	create("1")
+	create("2")
+	create("3")
+	// the first change after the backup slot was empty is backed up, the
+	// following ones aren't until the interval is over
+	if got := guilds(path + ".1"); got != 1 {
+		t.Errorf("newest backup has %v guilds, want 1", got)
+	}
+	if got := guilds(path + ".2"); got != -1 {
+		t.Errorf("oldest backup has %v guilds, want none", got)
+	}
+
+	old := time.Now().Add(-2 * jsonBackupInterval)
+	if err := os.Chtimes(path+".1", old, old); err != nil {
+		t.Fatal(err)
+	}
+	create("4")
+	if got := guilds(path + ".1"); got != 3 {
+		t.Errorf("newest backup has %v guilds after the interval, want 3", got)
+	}
+	if got := guilds(path + ".2"); got != 1 {
+		t.Errorf("oldest backup has %v guilds after the interval, want 1", got)
+	}
+	if got := guilds(path); got != 4 {
+		t.Errorf("database has %v guilds, want 4", got)
+	}
+}
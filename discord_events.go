@@ -2,13 +2,15 @@ package stare
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/dgraph-io/badger"
 	"github.com/intrntsrfr/meido/pkg/utils"
 	"github.com/intrntsrfr/meido/pkg/utils/builders"
 	"go.uber.org/zap"
@@ -38,7 +40,10 @@ func guildBanAddHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildBanAdd)
 			return
 		}
 
-		gc, err := b.db.GetGuild(g.ID)
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		gc, err := b.db.GetGuild(ctx, g.ID)
 		if err != nil {
 			b.logger.Error("failed to get guild", zap.Error(err))
 			return
@@ -51,39 +56,48 @@ func guildBanAddHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildBanAdd)
 			WithFooter(fmt.Sprintf("User ID: %v", d.User.ID), "").
 			WithColor(int(ColorRed))
 
-		if _, err = b.store.GetMember(d.GuildID, d.User.ID); err != nil {
-			if err != badger.ErrKeyNotFound {
+		if _, err = b.store.GetMember(ctx, d.GuildID, d.User.ID); err != nil {
+			if !errors.Is(err, ErrNotFound) {
 				b.logger.Error("failed to get member", zap.Error(err))
 			}
 			embed.WithDescription("User was not in the server")
 		}
 
 		// fetch their messages and attachments
-		messages, err := b.store.GetMessageLog(d.GuildID, d.User.ID)
-		if err != nil {
-			b.logger.Error("failed to get message log", zap.Error(err))
-		}
-
 		builder := strings.Builder{}
-		for _, msg := range messages {
-			ch, err := b.Bot.Discord.Channel(msg.Message.ChannelID)
-			if err != nil {
-				b.logger.Error("failed to fetch channel", zap.Error(err))
-				continue
+		count := 0
+		// the walk holds a transaction open, so channel names only come from
+		// the state cache
+		channelNames := make(map[string]string)
+		err = b.store.WalkMessageLog(ctx, d.GuildID, d.User.ID, MessageQuery{}, func(msg *DiscordMessage) error {
+			cid := msg.Message.ChannelID
+			name, ok := channelNames[cid]
+			if !ok {
+				name = "unknown channel"
+				if ch, err := s.State.Channel(cid); err == nil {
+					name = ch.Name
+				}
+				channelNames[cid] = name
 			}
 
 			ts := utils.IDToTimestamp(msg.Message.ID).Format(time.DateTime)
-			text := fmt.Sprintf("\nChannel: %v (%v)\nTimestamp: %v\nContent: %v\n", ch.Name, ch.ID, ts, msg.Message.Content)
+			text := fmt.Sprintf("\nChannel: %v (%v)\nTimestamp: %v\nContent: %v\n", name, cid, ts, msg.Message.Content)
 			if len(msg.Attachments) > 0 {
 				text += "Info: Message had attachment\n"
 			}
 			builder.WriteString(text)
+			count++
+			return nil
+		})
+		if err != nil {
+			b.logger.Error("failed to get message log", zap.Error(err))
 		}
 
 		reply := builders.NewMessageSendBuilder()
-		if len(messages) > 0 {
-			embed.AddField("24 hour message log", fmt.Sprintf("Log is attached\nMessages: %v", len(messages)), false)
-			reply.AddTextFile(fmt.Sprintf("24h_ban_log_%v_%v.txt", d.User.ID, time.Now().Unix()), builder.String())
+		if count > 0 {
+			hours := int(b.messageTTL(gc).Hours())
+			embed.AddField(fmt.Sprintf("%v message log", formatHours(hours)), fmt.Sprintf("Log is attached\nMessages: %v", count), false)
+			reply.AddTextFile(fmt.Sprintf("%vh_ban_log_%v_%v.txt", hours, d.User.ID, time.Now().Unix()), builder.String())
 		}
 
 		reply.Embed(embed.Build())
@@ -98,7 +112,10 @@ func guildBanRemoveHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildBanR
 			return
 		}
 
-		gc, err := b.db.GetGuild(g.ID)
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		gc, err := b.db.GetGuild(ctx, g.ID)
 		if err != nil {
 			b.logger.Error("failed to get guild", zap.Error(err))
 			return
@@ -116,41 +133,433 @@ func guildBanRemoveHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildBanR
 
 func guildCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildCreate) {
 	return func(s *discordgo.Session, d *discordgo.GuildCreate) {
-		if _, err := b.db.GetGuild(d.ID); err != nil {
-			err = b.db.CreateGuild(d.ID)
+		// every step gets its own deadline, as large guilds take a while to
+		// store
+		ctx, cancel := b.storageContext()
+		if _, err := b.db.GetGuild(ctx, d.ID); errors.Is(err, ErrGuildNotFound) {
+			err = b.db.CreateGuild(ctx, d.ID)
 			if err != nil {
 				b.logger.Error("failed to create new guild", zap.Error(err))
 			}
+		} else if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
 		}
+		cancel()
+
+		storeBatches(b, len(d.Channels), func(ctx context.Context, i int) {
+			c := d.Channels[i]
+			// channels in guild create events don't have the guild ID set
+			c.GuildID = d.ID
+			if err := b.store.SetChannel(ctx, c); err != nil {
+				b.logger.Error("failed to set channel", zap.Error(err))
+			}
+		})
+		storeBatches(b, len(d.Roles), func(ctx context.Context, i int) {
+			if err := b.store.SetRole(ctx, d.ID, d.Roles[i]); err != nil {
+				b.logger.Error("failed to set role", zap.Error(err))
+			}
+		})
+
+		ctx, cancel = b.storageContext()
+		syncVoiceSessions(ctx, b, d.ID, d.VoiceStates)
+		cancel()
 
 		if len(d.Members) != d.MemberCount {
 			_ = s.RequestGuildMembers(d.ID, "", 0, "", false)
 			return
 		}
+		storeMembers(b, d.Members)
+		expireLeftMembers(b, d.ID, memberIDs(d.Members))
+	}
+}
 
-		for _, mem := range d.Members {
-			err := b.store.SetMember(mem)
-			if err != nil {
-				b.logger.Error("failed to set member", zap.Error(err))
-				continue
+// memberSync collects the members of a guild from the chunks sent for a
+// member request, so the full member list is known once every chunk is in.
+type memberSync struct {
+	mu       sync.Mutex
+	requests map[string]*memberSyncRequest
+}
+
+type memberSyncRequest struct {
+	ids    map[string]bool
+	chunks int
+}
+
+// add adds the members of a chunk, and returns the IDs of every member of
+// the guild once the last chunk of the request is added.
+func (m *memberSync) add(d *discordgo.GuildMembersChunk) (map[string]bool, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = make(map[string]*memberSyncRequest)
+	}
+
+	key := d.GuildID + ":" + d.Nonce
+	r, ok := m.requests[key]
+	if !ok {
+		r = &memberSyncRequest{ids: make(map[string]bool)}
+		m.requests[key] = r
+	}
+	for _, mem := range d.Members {
+		r.ids[mem.User.ID] = true
+	}
+	r.chunks++
+	if r.chunks < d.ChunkCount {
+		return nil, false
+	}
+	delete(m.requests, key)
+	return r.ids, true
+}
+
+func memberIDs(members []*discordgo.Member) map[string]bool {
+	ids := make(map[string]bool, len(members))
+	for _, mem := range members {
+		ids[mem.User.ID] = true
+	}
+	return ids
+}
+
+// expireLeftMembers expires the history of the members of a guild who aren't
+// in members anymore, as they left while the bot was offline.
+func expireLeftMembers(b *Bot, gid string, members map[string]bool) {
+	ctx, cancel := b.storageContext()
+	ids, err := b.store.GetMemberHistoryIDs(ctx, gid)
+	cancel()
+	if err != nil {
+		b.logger.Error("failed to get member history IDs", zap.Error(err))
+		return
+	}
+
+	var left []string
+	for _, id := range ids {
+		if !members[id] {
+			left = append(left, id)
+		}
+	}
+	storeBatches(b, len(left), func(ctx context.Context, i int) {
+		if err := b.store.ExpireMemberHistory(ctx, gid, left[i]); err != nil {
+			b.logger.Error("failed to expire member history", zap.Error(err))
+		}
+	})
+}
+
+// storeBatchSize is how many store calls share a deadline when a lot of
+// members, channels or roles are stored at once.
+const storeBatchSize = 100
+
+// storeBatches calls fn for every index below n, giving every batch of
+// storeBatchSize calls its own storage context.
+func storeBatches(b *Bot, n int, fn func(ctx context.Context, i int)) {
+	for start := 0; start < n; start += storeBatchSize {
+		ctx, cancel := b.storageContext()
+		for i := start; i < min(start+storeBatchSize, n); i++ {
+			fn(ctx, i)
+		}
+		cancel()
+	}
+}
+
+func storeMembers(b *Bot, members []*discordgo.Member) {
+	storeBatches(b, len(members), func(ctx context.Context, i int) {
+		mem := members[i]
+		err := b.store.SetMember(ctx, mem)
+		if err != nil {
+			b.logger.Error("failed to set member", zap.Error(err))
+			return
+		}
+		err = b.store.AddMemberSnapshot(ctx, mem)
+		if err != nil {
+			b.logger.Error("failed to add member snapshot", zap.Error(err))
+		}
+	})
+}
+
+func channelCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.ChannelCreate) {
+	return func(s *discordgo.Session, d *discordgo.ChannelCreate) {
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		if d.GuildID == "" {
+			return
+		}
+		if err := b.store.SetChannel(ctx, d.Channel); err != nil {
+			b.logger.Error("failed to set channel", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(ctx, d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+		if gc.ChannelLog == "" {
+			return
+		}
+
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Channel Created").
+			AddField("Channel", fmt.Sprintf("<#%v>\n%v", d.ID, d.Name), false).
+			AddField("Type", channelTypeName(d.Type), true).
+			AddField("Category", formatCategory(d.ParentID), true).
+			WithFooter(fmt.Sprintf("Channel ID: %v", d.ID), "").
+			WithColor(int(ColorGreen))
+		if actor := auditLogActor(s, d.GuildID, d.ID, discordgo.AuditLogActionChannelCreate); actor != "" {
+			embed.AddField("Created by", fmt.Sprintf("<@%v>", actor), false)
+		}
+		_, _ = s.ChannelMessageSendEmbed(gc.ChannelLog, embed.Build())
+	}
+}
+
+func channelUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.ChannelUpdate) {
+	return func(s *discordgo.Session, d *discordgo.ChannelUpdate) {
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		if d.GuildID == "" {
+			return
+		}
+		old, err := b.store.GetChannel(ctx, d.GuildID, d.ID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			b.logger.Error("failed to get channel", zap.Error(err))
+		}
+		if err := b.store.SetChannel(ctx, d.Channel); err != nil {
+			b.logger.Error("failed to set channel", zap.Error(err))
+		}
+
+		// without the stored channel there is nothing to compare against
+		if old == nil {
+			return
+		}
+		fields := channelUpdateFields(old, d.Channel)
+		if len(fields) == 0 {
+			return
+		}
+
+		gc, err := b.db.GetGuild(ctx, d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+		if gc.ChannelLog == "" {
+			return
+		}
+
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Channel Updated").
+			AddField("Channel", fmt.Sprintf("<#%v>\n%v", d.ID, d.Name), false).
+			WithFooter(fmt.Sprintf("Channel ID: %v", d.ID), "").
+			WithColor(int(ColorBlue))
+		for _, f := range fields {
+			embed.AddField(f.Name, f.Value, false)
+		}
+		actor := auditLogActor(s, d.GuildID, d.ID,
+			discordgo.AuditLogActionChannelUpdate,
+			discordgo.AuditLogActionChannelOverwriteCreate,
+			discordgo.AuditLogActionChannelOverwriteUpdate,
+			discordgo.AuditLogActionChannelOverwriteDelete)
+		if actor != "" {
+			embed.AddField("Updated by", fmt.Sprintf("<@%v>", actor), false)
+		}
+		_, _ = s.ChannelMessageSendEmbed(gc.ChannelLog, embed.Build())
+	}
+}
+
+func channelDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.ChannelDelete) {
+	return func(s *discordgo.Session, d *discordgo.ChannelDelete) {
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		if d.GuildID == "" {
+			return
+		}
+		if err := b.store.DeleteChannel(ctx, d.GuildID, d.ID); err != nil {
+			b.logger.Error("failed to delete channel", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(ctx, d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+		if gc.ChannelLog == "" || gc.ChannelLog == d.ID {
+			return
+		}
+
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Channel Deleted").
+			AddField("Channel", fmt.Sprintf("#%v", d.Name), false).
+			AddField("Type", channelTypeName(d.Type), true).
+			AddField("Category", formatCategory(d.ParentID), true).
+			WithFooter(fmt.Sprintf("Channel ID: %v", d.ID), "").
+			WithColor(int(ColorRed))
+		if actor := auditLogActor(s, d.GuildID, d.ID, discordgo.AuditLogActionChannelDelete); actor != "" {
+			embed.AddField("Deleted by", fmt.Sprintf("<@%v>", actor), false)
+		}
+		_, _ = s.ChannelMessageSendEmbed(gc.ChannelLog, embed.Build())
+	}
+}
+
+func guildRoleCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildRoleCreate) {
+	return func(s *discordgo.Session, d *discordgo.GuildRoleCreate) {
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		if err := b.store.SetRole(ctx, d.GuildID, d.Role); err != nil {
+			b.logger.Error("failed to set role", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(ctx, d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+		if gc.RoleLog == "" {
+			return
+		}
+
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Role Created").
+			AddField("Role", formatRole(d.Role), false).
+			AddField("Colour", formatColor(d.Role.Color), true).
+			AddField("Displayed separately", formatBool(d.Role.Hoist), true).
+			AddField("Mentionable", formatBool(d.Role.Mentionable), true).
+			AddField("Permissions", formatPermissions(d.Role.Permissions), false).
+			WithFooter(fmt.Sprintf("Role ID: %v", d.Role.ID), "").
+			WithColor(int(ColorGreen))
+		if actor := auditLogActor(s, d.GuildID, d.Role.ID, discordgo.AuditLogActionRoleCreate); actor != "" {
+			embed.AddField("Created by", fmt.Sprintf("<@%v>", actor), false)
+		}
+		_, _ = s.ChannelMessageSendEmbed(gc.RoleLog, embed.Build())
+	}
+}
+
+func guildRoleUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildRoleUpdate) {
+	return func(s *discordgo.Session, d *discordgo.GuildRoleUpdate) {
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		old, err := b.store.GetRole(ctx, d.GuildID, d.Role.ID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			b.logger.Error("failed to get role", zap.Error(err))
+		}
+		if err := b.store.SetRole(ctx, d.GuildID, d.Role); err != nil {
+			b.logger.Error("failed to set role", zap.Error(err))
+		}
+
+		// without the stored role there is nothing to compare against
+		if old == nil {
+			return
+		}
+		fields := roleUpdateFields(old, d.Role)
+		if len(fields) == 0 {
+			return
+		}
+
+		gc, err := b.db.GetGuild(ctx, d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+		if gc.RoleLog == "" {
+			return
+		}
+
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Role Updated").
+			AddField("Role", formatRole(d.Role), false).
+			WithFooter(fmt.Sprintf("Role ID: %v", d.Role.ID), "").
+			WithColor(int(ColorBlue))
+		for _, f := range fields {
+			embed.AddField(f.Name, f.Value, false)
+		}
+		if actor := auditLogActor(s, d.GuildID, d.Role.ID, discordgo.AuditLogActionRoleUpdate); actor != "" {
+			embed.AddField("Updated by", fmt.Sprintf("<@%v>", actor), false)
+		}
+		_, _ = s.ChannelMessageSendEmbed(gc.RoleLog, embed.Build())
+	}
+}
+
+func guildRoleDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildRoleDelete) {
+	return func(s *discordgo.Session, d *discordgo.GuildRoleDelete) {
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		old, err := b.store.GetRole(ctx, d.GuildID, d.RoleID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			b.logger.Error("failed to get role", zap.Error(err))
+		}
+		if err := b.store.DeleteRole(ctx, d.GuildID, d.RoleID); err != nil {
+			b.logger.Error("failed to delete role", zap.Error(err))
+		}
+
+		gc, err := b.db.GetGuild(ctx, d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+		if gc.RoleLog == "" {
+			return
+		}
+
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Role Deleted").
+			WithFooter(fmt.Sprintf("Role ID: %v", d.RoleID), "").
+			WithColor(int(ColorRed))
+		if old != nil {
+			embed.AddField("Role", old.Name, false).
+				AddField("Colour", formatColor(old.Color), true).
+				AddField("Permissions", formatPermissions(old.Permissions), false)
+		} else {
+			embed.AddField("Role", "Unknown", false)
+		}
+		if actor := auditLogActor(s, d.GuildID, d.RoleID, discordgo.AuditLogActionRoleDelete); actor != "" {
+			embed.AddField("Deleted by", fmt.Sprintf("<@%v>", actor), false)
+		}
+		_, _ = s.ChannelMessageSendEmbed(gc.RoleLog, embed.Build())
+	}
+}
+
+// auditLogWindow is how long after an audit log entry was made it is taken
+// to belong to an event.
+const auditLogWindow = 15 * time.Second
+
+// auditLogActor looks up who made the latest change with one of the actions
+// to target in the audit log. It returns an empty string if the change isn't
+// found, or the bot can't view the audit log.
+func auditLogActor(s *discordgo.Session, gid, target string, actions ...discordgo.AuditLogAction) string {
+	for _, action := range actions {
+		log, err := s.GuildAuditLog(gid, "", "", int(action), 5)
+		if err != nil {
+			return ""
+		}
+		for _, e := range log.AuditLogEntries {
+			if e.TargetID == target && time.Since(utils.IDToTimestamp(e.ID)) < auditLogWindow {
+				return e.UserID
 			}
 		}
 	}
+	return ""
 }
 
 func guildMemberAddHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildMemberAdd) {
 	return func(s *discordgo.Session, d *discordgo.GuildMemberAdd) {
-		err := b.store.SetMember(d.Member)
+		g, guildErr := b.Bot.Discord.Guild(d.GuildID)
+
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		err := b.store.SetMember(ctx, d.Member)
 		if err != nil {
 			b.logger.Error("failed to set member", zap.Error(err))
 		}
+		if err := b.store.AddMemberSnapshot(ctx, d.Member); err != nil {
+			b.logger.Error("failed to add member snapshot", zap.Error(err))
+		}
 
-		g, err := b.Bot.Discord.Guild(d.GuildID)
-		if err != nil {
+		if guildErr != nil {
 			return
 		}
 
-		gc, err := b.db.GetGuild(g.ID)
+		gc, err := b.db.GetGuild(ctx, g.ID)
 		if err != nil {
 			b.logger.Error("failed to get guild", zap.Error(err))
 			return
@@ -170,19 +579,30 @@ func guildMemberAddHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildMemb
 
 func guildMemberRemoveHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildMemberRemove) {
 	return func(s *discordgo.Session, d *discordgo.GuildMemberRemove) {
-		g, err := b.Bot.Discord.Guild(d.GuildID)
-		if err != nil {
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		// the member is forgotten whether or not the leave can be logged, so
+		// their history always starts expiring
+		mem, memErr := b.store.GetMember(ctx, d.GuildID, d.User.ID)
+		if err := b.store.DeleteMember(ctx, d.GuildID, d.User.ID); err != nil {
+			b.logger.Error("failed to delete member", zap.Error(err))
+		}
+		if err := b.store.ExpireMemberHistory(ctx, d.GuildID, d.User.ID); err != nil {
+			b.logger.Error("failed to expire member history", zap.Error(err))
+		}
+		if memErr != nil {
 			return
 		}
 
-		gc, err := b.db.GetGuild(g.ID)
+		g, err := b.Bot.Discord.Guild(d.GuildID)
 		if err != nil {
-			b.logger.Error("failed to get guild", zap.Error(err))
 			return
 		}
 
-		mem, err := b.store.GetMember(d.GuildID, d.User.ID)
+		gc, err := b.db.GetGuild(ctx, g.ID)
 		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
 			return
 		}
 
@@ -193,83 +613,158 @@ func guildMemberRemoveHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildM
 			WithFooter(fmt.Sprintf("User ID: %v", d.User.ID), "").
 			WithColor(int(ColorOrange))
 
-		var roles []string
-		for _, r := range mem.Roles {
-			roles = append(roles, fmt.Sprintf("<@&%v>", r))
-		}
+		embed.AddField("Roles", formatRoleMentions(mem.Roles), false)
+		_, _ = s.ChannelMessageSendEmbed(gc.LeaveLog, embed.Build())
+	}
+}
 
-		if len(roles) <= 0 {
-			embed.AddField("Roles", "None", false)
-		} else {
-			var shown []string
-			for _, r := range roles {
-				if len(strings.Join(append(shown, r), ", ")) > 760 {
-					break
-				}
-				shown = append(shown, r)
-			}
+// formatRoleMentions mentions roles, leaving out the ones that don't fit in an
+// embed field.
+func formatRoleMentions(roles []string) string {
+	if len(roles) == 0 {
+		return "None"
+	}
 
-			embedStr := strings.Join(shown, ", ")
-			if len(shown) != len(roles) {
-				embedStr += fmt.Sprintf(" and %v more", len(roles)-len(shown))
-			}
-			embed.AddField("Roles", embedStr, false)
+	var shown []string
+	for _, r := range roles {
+		mention := fmt.Sprintf("<@&%v>", r)
+		if len(strings.Join(append(shown, mention), ", ")) > 760 {
+			break
 		}
+		shown = append(shown, mention)
+	}
 
-		_, _ = s.ChannelMessageSendEmbed(gc.LeaveLog, embed.Build())
-		err = b.store.DeleteMember(d.GuildID, d.User.ID)
-		if err != nil {
-			b.logger.Error("failed to delete member", zap.Error(err))
-		}
+	text := strings.Join(shown, ", ")
+	if len(shown) != len(roles) {
+		text += fmt.Sprintf(" and %v more", len(roles)-len(shown))
 	}
+	return text
 }
 
 func guildMembersChunkHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildMembersChunk) {
 	return func(s *discordgo.Session, d *discordgo.GuildMembersChunk) {
-		for _, mem := range d.Members {
-			err := b.store.SetMember(mem)
-			if err != nil {
-				b.logger.Error("failed to set member", zap.Error(err))
-				continue
-			}
+		storeMembers(b, d.Members)
+		if members, ok := b.memberSync.add(d); ok {
+			expireLeftMembers(b, d.GuildID, members)
 		}
 	}
 }
 
 func guildMemberUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.GuildMemberUpdate) {
 	return func(s *discordgo.Session, d *discordgo.GuildMemberUpdate) {
-		err := b.store.SetMember(d.Member)
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		old, err := b.store.GetMember(ctx, d.GuildID, d.User.ID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			b.logger.Error("failed to get member", zap.Error(err))
+		}
+
+		err = b.store.SetMember(ctx, d.Member)
 		if err != nil {
 			b.logger.Error("failed to update member", zap.Error(err))
 			return
 		}
+		err = b.store.AddMemberSnapshot(ctx, d.Member)
+		if err != nil {
+			b.logger.Error("failed to add member snapshot", zap.Error(err))
+		}
+
+		// without the stored member there is nothing to compare against
+		if old == nil {
+			return
+		}
+
+		gc, err := b.db.GetGuild(ctx, d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+		if gc.MemberUpdateLog == "" {
+			return
+		}
+
+		for _, embed := range memberUpdateEmbeds(old, d.Member) {
+			_, _ = s.ChannelMessageSendEmbed(gc.MemberUpdateLog, embed)
+		}
 	}
 }
 
+// memberUpdateEmbeds describes how the nickname and roles of a member changed.
+func memberUpdateEmbeds(old, cur *discordgo.Member) []*discordgo.MessageEmbed {
+	var embeds []*discordgo.MessageEmbed
+	user := fmt.Sprintf("%v\n%v", cur.User.Mention(), cur.User.String())
+
+	if old.Nick != cur.Nick {
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Nickname Changed").
+			WithThumbnail(cur.User.AvatarURL("256")).
+			AddField("User", user, false).
+			AddField("Old nickname", formatNick(old.Nick), true).
+			AddField("New nickname", formatNick(cur.Nick), true).
+			WithFooter(fmt.Sprintf("User ID: %v", cur.User.ID), "").
+			WithColor(int(ColorBlue))
+		embeds = append(embeds, embed.Build())
+	}
+
+	added, removed := diffRoles(old.Roles, cur.Roles)
+	if len(added) > 0 || len(removed) > 0 {
+		embed := builders.NewEmbedBuilder().
+			WithTitle("Roles Changed").
+			WithThumbnail(cur.User.AvatarURL("256")).
+			AddField("User", user, false).
+			WithFooter(fmt.Sprintf("User ID: %v", cur.User.ID), "").
+			WithColor(int(ColorBlue))
+		if len(added) > 0 {
+			embed.AddField("Added", formatRoleMentions(added), false)
+		}
+		if len(removed) > 0 {
+			embed.AddField("Removed", formatRoleMentions(removed), false)
+		}
+		embeds = append(embeds, embed.Build())
+	}
+	return embeds
+}
+
 func messageCreateHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageCreate) {
 	return func(s *discordgo.Session, d *discordgo.MessageCreate) {
 		if d.Author.Bot {
 			return
 		}
+		msg := NewDiscordMessage(d.Message)
 
-		// max size 10mb
-		_ = b.store.SetMessage(NewDiscordMessage(d.Message, 1024*1024*10))
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		var ttl time.Duration
+		if gc, err := b.db.GetGuild(ctx, d.GuildID); err == nil {
+			ttl = b.messageTTL(gc)
+		}
+
+		if err := b.store.SetMessage(ctx, msg, ttl); err != nil {
+			b.logger.Error("failed to set message", zap.Error(err))
+			return
+		}
+		b.fetcher.Enqueue(d.Message)
 	}
 }
 
 func messageDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageDelete) {
 	return func(s *discordgo.Session, d *discordgo.MessageDelete) {
-		msg, err := b.store.GetMessage(d.GuildID, d.ChannelID, d.ID)
+		g, err := b.Bot.Discord.Guild(d.GuildID)
 		if err != nil {
 			return
 		}
 
-		g, err := b.Bot.Discord.Guild(d.GuildID)
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		msg, err := b.store.GetMessage(ctx, d.GuildID, d.ChannelID, d.ID)
 		if err != nil {
 			return
 		}
 
-		gc, err := b.db.GetGuild(g.ID)
+		gc, err := b.db.GetGuild(ctx, g.ID)
 		if err != nil {
 			b.logger.Error("failed to get guild", zap.Error(err))
 			return
@@ -293,6 +788,16 @@ func messageDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageDel
 			embed.WithDescription(descStr)
 		}
 
+		if len(msg.Revisions) > 0 {
+			history := formatEditHistory(msg)
+			if len(history) > 1024 {
+				embed.AddField("Edit history", fmt.Sprintf("Edited %v times, the history is put in the attached .txt file", len(msg.Revisions)), false)
+				reply.AddTextFile("edit_history.txt", history)
+			} else {
+				embed.AddField("Edit history", history, false)
+			}
+		}
+
 		if len(msg.Attachments) > 0 {
 			embed.AddField("Total fetched attachments", fmt.Sprint(len(msg.Attachments)), false)
 			embed.WithDescription(embed.Description + "\n**Disclaimer:** Only attachments smaller than 10mb may be fetched")
@@ -311,6 +816,32 @@ func messageDeleteHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageDel
 	}
 }
 
+// formatEditHistory lists every revision of an edited message, oldest first.
+func formatEditHistory(msg *DiscordMessage) string {
+	builder := strings.Builder{}
+	writeRevision := func(n int, ts time.Time, content string, attachments int) {
+		fmt.Fprintf(&builder, "Revision %v (%v)\n", n, ts.Format(time.DateTime))
+		if content == "" {
+			content = "No content"
+		}
+		builder.WriteString(content + "\n")
+		if attachments > 0 {
+			fmt.Fprintf(&builder, "Attachments: %v\n", attachments)
+		}
+		builder.WriteString("\n")
+	}
+
+	for i, rev := range msg.Revisions {
+		writeRevision(i, rev.Timestamp, rev.Content, len(rev.Attachments))
+	}
+	ts := msg.Message.Timestamp
+	if msg.Message.EditedTimestamp != nil {
+		ts = *msg.Message.EditedTimestamp
+	}
+	writeRevision(msg.Revision(), ts, msg.Message.Content, len(msg.Message.Attachments))
+	return strings.TrimSpace(builder.String())
+}
+
 func messageDeleteBulkHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageDeleteBulk) {
 	return func(s *discordgo.Session, d *discordgo.MessageDeleteBulk) {
 		g, err := b.Bot.Discord.Guild(d.GuildID)
@@ -318,7 +849,10 @@ func messageDeleteBulkHandler(b *Bot) func(*discordgo.Session, *discordgo.Messag
 			return
 		}
 
-		gc, err := b.db.GetGuild(g.ID)
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		gc, err := b.db.GetGuild(ctx, g.ID)
 		if err != nil {
 			b.logger.Error("failed to get guild", zap.Error(err))
 			return
@@ -331,7 +865,7 @@ func messageDeleteBulkHandler(b *Bot) func(*discordgo.Session, *discordgo.Messag
 
 		var messages []*DiscordMessage
 		for _, msgID := range d.Messages {
-			msg, err := b.store.GetMessage(d.GuildID, d.ChannelID, msgID)
+			msg, err := b.store.GetMessage(ctx, d.GuildID, d.ChannelID, msgID)
 			if err != nil {
 				continue
 			}
@@ -360,6 +894,10 @@ func messageDeleteBulkHandler(b *Bot) func(*discordgo.Session, *discordgo.Messag
 	}
 }
 
+// errNotEdited is returned from UpdateMessage to leave a message that wasn't
+// edited as it is.
+var errNotEdited = errors.New("message not edited")
+
 func messageUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageUpdate) {
 	return func(s *discordgo.Session, d *discordgo.MessageUpdate) {
 		// This means it was an image update and not an actual edit
@@ -373,24 +911,41 @@ func messageUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageUpd
 			return
 		}
 
-		gc, err := b.db.GetGuild(g.ID)
+		ctx, cancel := b.storageContext()
+		defer cancel()
+
+		gc, err := b.db.GetGuild(ctx, g.ID)
 		if err != nil {
 			b.logger.Error("failed to get guild", zap.Error(err))
 			return
 		}
 
-		oldMsg, err := b.store.GetMessage(d.GuildID, d.ChannelID, d.ID)
-		if err != nil || (oldMsg.Message.Author != nil && oldMsg.Message.Author.Bot) {
+		// keep the old version before storing the new one as its own
+		// revision, in one go so attachments downloaded in the meantime are
+		// kept
+		var oldContent string
+		var revision int
+		err = b.store.UpdateMessage(ctx, d.GuildID, d.ChannelID, d.ID, func(msg *DiscordMessage) error {
+			if (msg.Message.Author != nil && msg.Message.Author.Bot) || msg.Message.Content == d.Content {
+				return errNotEdited
+			}
+			oldContent = msg.Message.Content
+			msg.AddRevision(d.Message)
+			revision = msg.Revision()
+			return nil
+		})
+		if errors.Is(err, errNotEdited) || errors.Is(err, ErrNotFound) {
 			return
 		}
-
-		if oldMsg.Message.Content == d.Content {
+		if err != nil {
+			b.logger.Error("failed to update message", zap.Error(err))
 			return
 		}
 
 		embed := builders.NewEmbedBuilder().
 			WithTitle("Message Edited").
 			AddField("User", fmt.Sprintf("%v\n%v\n%v", d.Author.Mention(), d.Author.String(), d.Author.ID), true).
+			AddField("Revision", fmt.Sprint(revision), true).
 			AddField("Channel", fmt.Sprintf("<#%v> (%v)", d.ChannelID, d.ChannelID), false).
 			WithFooter(fmt.Sprintf("Message ID: %v", d.ID), "").
 			WithColor(int(ColorBlue))
@@ -398,11 +953,11 @@ func messageUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageUpd
 		reply := builders.NewMessageSendBuilder()
 
 		// check old content
-		if len(oldMsg.Message.Content) > 1024 {
+		if len(oldContent) > 1024 {
 			embed.AddField("Old content", "Content too long, so it's put in the attached .txt file", false)
-			reply.AddTextFile("old_content.txt", oldMsg.Message.Content)
+			reply.AddTextFile("old_content.txt", oldContent)
 		} else {
-			embed.AddField("Old content", oldMsg.Message.Content, false)
+			embed.AddField("Old content", oldContent, false)
 		}
 
 		// check new content
@@ -415,13 +970,79 @@ func messageUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.MessageUpd
 
 		reply.Embed(embed.Build())
 		_, _ = s.ChannelMessageSendComplex(gc.MsgEditLog, reply.Build())
+	}
+}
+
+func voiceStateUpdateHandler(b *Bot) func(*discordgo.Session, *discordgo.VoiceStateUpdate) {
+	return func(s *discordgo.Session, d *discordgo.VoiceStateUpdate) {
+		ctx, cancel := b.storageContext()
+		defer cancel()
 
-		// I think this should be put in its own function and not at the end of this one lol
-		oldMsg.Message.Content = d.Content
-		err = b.store.SetMessage(oldMsg)
+		if d.GuildID == "" {
+			return
+		}
+		old, err := b.store.GetVoiceSession(ctx, d.GuildID, d.UserID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			b.logger.Error("failed to get voice session", zap.Error(err))
+			return
+		}
+
+		now := time.Now()
+		if d.ChannelID == "" {
+			err = b.store.DeleteVoiceSession(ctx, d.GuildID, d.UserID)
+		} else {
+			joinedAt := now
+			if old != nil {
+				joinedAt = old.JoinedAt
+			}
+			err = b.store.SetVoiceSession(ctx, d.GuildID, d.UserID, newVoiceSession(d.VoiceState, joinedAt))
+		}
 		if err != nil {
-			b.logger.Error("failed to update message", zap.Error(err))
+			b.logger.Error("failed to update voice session", zap.Error(err))
+		}
+
+		embeds := voiceStateEmbeds(old, d.VoiceState, now)
+		if len(embeds) == 0 {
+			return
+		}
+
+		gc, err := b.db.GetGuild(ctx, d.GuildID)
+		if err != nil {
+			b.logger.Error("failed to get guild", zap.Error(err))
+			return
+		}
+		if gc.VoiceLog == "" {
 			return
 		}
+		_, _ = s.ChannelMessageSendEmbeds(gc.VoiceLog, embeds)
+	}
+}
+
+// syncVoiceSessions makes the stored voice sessions of a guild match its
+// voice states, dropping the sessions of members who left voice while the
+// bot was offline. Sessions of members who are still in the same channel
+// keep their join time.
+func syncVoiceSessions(ctx context.Context, b *Bot, gid string, states []*discordgo.VoiceState) {
+	sessions, err := b.store.GetVoiceSessions(ctx, gid)
+	if err != nil {
+		b.logger.Error("failed to get voice sessions", zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	for _, vs := range states {
+		joinedAt := now
+		if old, ok := sessions[vs.UserID]; ok && old.ChannelID == vs.ChannelID {
+			joinedAt = old.JoinedAt
+		}
+		delete(sessions, vs.UserID)
+		if err := b.store.SetVoiceSession(ctx, gid, vs.UserID, newVoiceSession(vs, joinedAt)); err != nil {
+			b.logger.Error("failed to set voice session", zap.Error(err))
+		}
+	}
+	for uid := range sessions {
+		if err := b.store.DeleteVoiceSession(ctx, gid, uid); err != nil {
+			b.logger.Error("failed to delete voice session", zap.Error(err))
+		}
 	}
 }
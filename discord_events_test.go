@@ -0,0 +1,72 @@
+package stare
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestMemberSync(t *testing.T) {
+	chunk := func(gid, nonce string, index, count int, uids ...string) *discordgo.GuildMembersChunk {
+		d := &discordgo.GuildMembersChunk{GuildID: gid, Nonce: nonce, ChunkIndex: index, ChunkCount: count}
+		for _, uid := range uids {
+			d.Members = append(d.Members, &discordgo.Member{User: &discordgo.User{ID: uid}})
+		}
+		return d
+	}
+
+	tests := []struct {
+		name   string
+		chunks []*discordgo.GuildMembersChunk
+		// want are the member IDs returned after each chunk, nil while the
+		// request isn't complete
+		want [][]string
+	}{
+		{
+			name:   "single chunk",
+			chunks: []*discordgo.GuildMembersChunk{chunk("1", "", 0, 1, "2", "3")},
+			want:   [][]string{{"2", "3"}},
+		},
+		{
+			name: "out of order",
+			chunks: []*discordgo.GuildMembersChunk{
+				chunk("1", "", 1, 2, "3"),
+				chunk("1", "", 0, 2, "2"),
+			},
+			want: [][]string{nil, {"2", "3"}},
+		},
+		{
+			name: "separate requests",
+			chunks: []*discordgo.GuildMembersChunk{
+				chunk("1", "a", 0, 2, "2"),
+				chunk("1", "b", 0, 1, "4"),
+				chunk("5", "a", 0, 1, "6"),
+				chunk("1", "a", 1, 2, "3"),
+			},
+			want: [][]string{nil, {"4"}, {"6"}, {"2", "3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m memberSync
+			for i, d := range tt.chunks {
+				ids, done := m.add(d)
+				if done != (tt.want[i] != nil) {
+					t.Fatalf("chunk %v: done = %v, want %v", i, done, tt.want[i] != nil)
+				}
+				var got []string
+				for id := range ids {
+					got = append(got, id)
+				}
+				slices.Sort(got)
+				if done && !slices.Equal(got, tt.want[i]) {
+					t.Errorf("chunk %v: members = %v, want %v", i, got, tt.want[i])
+				}
+			}
+			if len(m.requests) != 0 {
+				t.Errorf("%v requests left over", len(m.requests))
+			}
+		})
+	}
+}
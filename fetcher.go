@@ -0,0 +1,296 @@
+package stare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/intrntsrfr/meido/pkg/mio"
+	"github.com/intrntsrfr/meido/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// FetcherConfig configures how attachments are downloaded.
+type FetcherConfig struct {
+	// Workers is the number of concurrent downloads
+	Workers int
+	// QueueSize is the number of messages that can wait for their attachments
+	// to be downloaded before new ones are dropped
+	QueueSize int
+	// Timeout is how long a single download may take
+	Timeout time.Duration
+	// Retries is how many times a failed download is retried
+	Retries int
+	// MaxSize is the largest attachment in bytes that is downloaded
+	MaxSize int
+	// GuildBudget is how many bytes may be downloaded for a single guild per
+	// BudgetWindow
+	GuildBudget  int64
+	BudgetWindow time.Duration
+}
+
+func DefaultFetcherConfig() *FetcherConfig {
+	return &FetcherConfig{
+		Workers:      4,
+		QueueSize:    1000,
+		Timeout:      30 * time.Second,
+		Retries:      2,
+		MaxSize:      1024 * 1024 * 10,
+		GuildBudget:  1024 * 1024 * 500,
+		BudgetWindow: time.Hour,
+	}
+}
+
+// NewFetcherConfig reads the fetcher settings from config, using the
+// defaults for anything that is missing.
+func NewFetcherConfig(config *utils.Config) (*FetcherConfig, error) {
+	c := DefaultFetcherConfig()
+	if v := config.GetInt("fetch_workers"); v > 0 {
+		c.Workers = v
+	}
+	if v := config.GetInt("fetch_queue_size"); v > 0 {
+		c.QueueSize = v
+	}
+	// 0 turns retries off, so only a missing setting uses the default
+	if v := config.GetInt("fetch_retries"); v >= 0 {
+		c.Retries = v
+	}
+	if v := config.GetInt("guild_attachment_budget"); v > 0 {
+		c.GuildBudget = int64(v)
+	}
+	if v := config.GetString("fetch_timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fetch_timeout: %w", err)
+		}
+		// a client without a timeout waits forever on a stalled download
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid fetch_timeout: %v is not positive", v)
+		}
+		c.Timeout = d
+	}
+	return c, nil
+}
+
+// errTooLarge is returned for downloads larger than the max size, which
+// happens when an attachment is larger than its reported size.
+var errTooLarge = errors.New("attachment is larger than the max size")
+
+// AttachmentFetcher downloads message attachments in the background with a
+// bounded number of workers, and adds them to the stored message once done.
+type AttachmentFetcher struct {
+	store  MessageStore
+	config *FetcherConfig
+	client *http.Client
+	logger mio.Logger
+
+	jobs    chan *discordgo.Message
+	dropped atomic.Uint64
+
+	budgetMu sync.Mutex
+	budgets  map[string]*guildBudget
+	// pruned is when expired budgets were last removed
+	pruned time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type guildBudget struct {
+	windowStart time.Time
+	used        int64
+}
+
+type FetcherStats struct {
+	// QueueDepth is the number of messages waiting for their attachments to
+	// be downloaded
+	QueueDepth int
+	// Dropped is the number of messages whose attachments were not
+	// downloaded because the queue was full
+	Dropped uint64
+}
+
+func NewAttachmentFetcher(store MessageStore, config *FetcherConfig, logger mio.Logger) *AttachmentFetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &AttachmentFetcher{
+		store:   store,
+		config:  config,
+		client:  &http.Client{Timeout: config.Timeout},
+		logger:  logger.Named("fetcher"),
+		jobs:    make(chan *discordgo.Message, config.QueueSize),
+		budgets: make(map[string]*guildBudget),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		f.wg.Add(1)
+		go f.work()
+	}
+	return f
+}
+
+// Close cancels in-flight downloads and waits for the workers to stop.
+// Queued messages are dropped.
+func (f *AttachmentFetcher) Close() {
+	f.cancel()
+	f.wg.Wait()
+}
+
+// Enqueue queues the attachments of msg for downloading. If the queue is
+// full, the attachments are dropped.
+func (f *AttachmentFetcher) Enqueue(msg *discordgo.Message) {
+	if len(msg.Attachments) == 0 || f.ctx.Err() != nil {
+		return
+	}
+
+	select {
+	case f.jobs <- msg:
+	default:
+		f.dropped.Add(1)
+		f.logger.Warn("attachment queue is full, dropping attachments", zap.String("messageID", msg.ID))
+	}
+}
+
+func (f *AttachmentFetcher) Stats() FetcherStats {
+	return FetcherStats{
+		QueueDepth: len(f.jobs),
+		Dropped:    f.dropped.Load(),
+	}
+}
+
+func (f *AttachmentFetcher) work() {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case msg := <-f.jobs:
+			f.fetch(msg)
+		}
+	}
+}
+
+func (f *AttachmentFetcher) fetch(msg *discordgo.Message) {
+	var attachments []*Attachment
+	for _, a := range msg.Attachments {
+		if a.Size > f.config.MaxSize {
+			continue
+		}
+		if !f.reserve(msg.GuildID, int64(a.Size)) {
+			f.logger.Debug("guild attachment budget exceeded", zap.String("guildID", msg.GuildID))
+			continue
+		}
+
+		data, err := f.download(a.URL)
+		if err != nil {
+			if f.ctx.Err() == nil {
+				f.logger.Error("failed to download attachment", zap.String("url", a.URL), zap.Error(err))
+			}
+			continue
+		}
+
+		attachments = append(attachments, &Attachment{
+			Filename: a.Filename,
+			Size:     a.Size,
+			Data:     data,
+		})
+	}
+	if len(attachments) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(f.ctx, storageTimeout)
+	defer cancel()
+	err := f.store.AddAttachments(ctx, msg.GuildID, msg.ChannelID, msg.ID, attachments)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		f.logger.Error("failed to store attachments", zap.String("messageID", msg.ID), zap.Error(err))
+	}
+}
+
+// reserve takes size bytes from the budget of the guild, and reports whether
+// there was enough left.
+func (f *AttachmentFetcher) reserve(gid string, size int64) bool {
+	f.budgetMu.Lock()
+	defer f.budgetMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.pruned) > f.config.BudgetWindow {
+		f.prune(now)
+	}
+
+	b, ok := f.budgets[gid]
+	if !ok || now.Sub(b.windowStart) > f.config.BudgetWindow {
+		b = &guildBudget{windowStart: now}
+		f.budgets[gid] = b
+	}
+	if b.used+size > f.config.GuildBudget {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+// prune removes the budgets whose window is over, so guilds that stopped
+// sending attachments don't keep their budget around. budgetMu must be held.
+func (f *AttachmentFetcher) prune(now time.Time) {
+	for gid, b := range f.budgets {
+		if now.Sub(b.windowStart) > f.config.BudgetWindow {
+			delete(f.budgets, gid)
+		}
+	}
+	f.pruned = now
+}
+
+// download fetches url, retrying with a growing delay when it fails.
+func (f *AttachmentFetcher) download(url string) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= f.config.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-f.ctx.Done():
+				return nil, f.ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+
+		var data []byte
+		data, err = f.get(url)
+		if err == nil || errors.Is(err, errTooLarge) {
+			return data, err
+		}
+	}
+	return nil, err
+}
+
+func (f *AttachmentFetcher) get(url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %v", res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, int64(f.config.MaxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > f.config.MaxSize {
+		return nil, errTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,126 @@
+package stare
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intrntsrfr/meido/pkg/utils"
+)
+
+func TestNewFetcherConfigRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries *int
+		want    int
+	}{
+		{"missing", nil, DefaultFetcherConfig().Retries},
+		{"zero", new(int), 0},
+		{"set", func() *int { n := 5; return &n }(), 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := utils.NewConfig()
+			if tt.retries != nil {
+				cfg.Set("fetch_retries", *tt.retries)
+			}
+			c, err := NewFetcherConfig(cfg)
+			if err != nil {
+				t.Fatalf("NewFetcherConfig: %v", err)
+			}
+			if c.Retries != tt.want {
+				t.Errorf("Retries = %v, want %v", c.Retries, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFetcherConfigTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"missing", "", DefaultFetcherConfig().Timeout, false},
+		{"set", "5s", 5 * time.Second, false},
+		{"zero", "0s", 0, true},
+		{"negative", "-1s", 0, true},
+		{"invalid", "soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := utils.NewConfig()
+			if tt.timeout != "" {
+				cfg.Set("fetch_timeout", tt.timeout)
+			}
+			c, err := NewFetcherConfig(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewFetcherConfig error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && c.Timeout != tt.want {
+				t.Errorf("Timeout = %v, want %v", c.Timeout, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetcherDownloadMaxSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", len(r.URL.Path)-1)))
+	}))
+	defer srv.Close()
+
+	config := DefaultFetcherConfig()
+	config.Workers = 0
+	config.MaxSize = 4
+	f := NewAttachmentFetcher(nil, config, NewLogger("test"))
+	defer f.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr error
+	}{
+		{"below max size", "/abc", nil},
+		{"at max size", "/abcd", nil},
+		{"over max size", "/abcde", errTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := f.download(srv.URL + tt.path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("download error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(data) != len(tt.path)-1 {
+				t.Errorf("downloaded %v bytes, want %v", len(data), len(tt.path)-1)
+			}
+		})
+	}
+}
+
+func TestFetcherPrunesBudgets(t *testing.T) {
+	config := DefaultFetcherConfig()
+	config.Workers = 0
+	config.BudgetWindow = time.Hour
+	f := NewAttachmentFetcher(nil, config, NewLogger("test"))
+	defer f.Close()
+
+	f.reserve("1", 10)
+	f.reserve("2", 10)
+	f.budgets["1"].windowStart = time.Now().Add(-2 * time.Hour)
+	f.pruned = time.Now().Add(-2 * time.Hour)
+
+	if !f.reserve("2", 10) {
+		t.Fatal("reserve failed with budget left")
+	}
+	if _, ok := f.budgets["1"]; ok {
+		t.Error("expired budget of guild 1 was not pruned")
+	}
+	if b := f.budgets["2"]; b == nil || b.used != 20 {
+		t.Errorf("budget of guild 2 = %+v, want 20 bytes used", b)
+	}
+}
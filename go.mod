@@ -9,6 +9,8 @@ require (
 	github.com/dgraph-io/badger v1.6.2
 	github.com/intrntsrfr/meido v0.0.0-20241230061356-a523f533b93d
 	github.com/jmoiron/sqlx v1.3.5
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.22
 	go.uber.org/zap v1.26.0
 )
 
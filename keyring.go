@@ -0,0 +1,149 @@
+package stare
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Encrypted values start with encryptedMagic, followed by the ID of the key
+// they were encrypted with, the nonce and the AES-GCM sealed data. Like
+// recordMagic, the magic byte can't be the start of a gob stream.
+const (
+	encryptedMagic byte = 0xe1
+	keyIDSize           = 4
+)
+
+var (
+	errDecrypt = errors.New("failed to decrypt value")
+	// errUnknownKey is returned for values encrypted with a key that isn't
+	// in the keyring, such as a key that was removed too early
+	errUnknownKey = errors.New("value is encrypted with an unknown key")
+)
+
+// Keyring encrypts values with its first key, and decrypts values encrypted
+// with any of its keys, so keys can be rotated by adding a new key in front
+// of the old ones.
+type Keyring struct {
+	keys []*encryptionKey
+}
+
+type encryptionKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// NewKeyring creates a keyring from AES keys, each 16, 24 or 32 bytes long.
+// A keyring without keys leaves values unencrypted.
+func NewKeyring(keys [][]byte) (*Keyring, error) {
+	k := &Keyring{}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %v: %w", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		k.keys = append(k.keys, &encryptionKey{
+			id:   sum[:keyIDSize],
+			aead: aead,
+		})
+	}
+	return k, nil
+}
+
+// ParseKeys decodes base64 encoded encryption keys.
+func ParseKeys(encoded []string) ([][]byte, error) {
+	var keys [][]byte
+	for i, e := range encoded {
+		key, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %v: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Enabled reports whether new values are encrypted.
+func (k *Keyring) Enabled() bool {
+	return len(k.keys) > 0
+}
+
+// Seal encrypts data with the active key.
+func (k *Keyring) Seal(data []byte) ([]byte, error) {
+	if !k.Enabled() {
+		return data, nil
+	}
+
+	key := k.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 1+keyIDSize+len(nonce)+len(data)+key.aead.Overhead())
+	out = append(out, encryptedMagic)
+	out = append(out, key.id...)
+	out = append(out, nonce...)
+	return key.aead.Seal(out, nonce, data, nil), nil
+}
+
+// Open decrypts data encrypted by any key in the keyring. Data that was not
+// encrypted is returned as is, so values written before encryption was
+// enabled stay readable. Data encrypted with a key that isn't in the keyring
+// returns errUnknownKey.
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	key := k.keyFor(data)
+	if key == nil {
+		return nil, errUnknownKey
+	}
+
+	data = data[1+keyIDSize:]
+	nonceSize := key.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errDecrypt
+	}
+	plain, err := key.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plain, nil
+}
+
+// IsCurrent reports whether data is stored the way Seal would store it now,
+// that is encrypted with the active key, or unencrypted without any keys.
+// Data encrypted with an unknown key is never current.
+func (k *Keyring) IsCurrent(data []byte) bool {
+	if !k.Enabled() {
+		return !isEncrypted(data)
+	}
+	return k.keyFor(data) == k.keys[0]
+}
+
+func isEncrypted(data []byte) bool {
+	return len(data) >= 1+keyIDSize && data[0] == encryptedMagic
+}
+
+func (k *Keyring) keyFor(data []byte) *encryptionKey {
+	if !isEncrypted(data) {
+		return nil
+	}
+	for _, key := range k.keys {
+		if bytes.Equal(data[1:1+keyIDSize], key.id) {
+			return key
+		}
+	}
+	return nil
+}
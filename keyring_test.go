@@ -0,0 +1,127 @@
+package stare
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeyring(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 16)
+	removedKey := bytes.Repeat([]byte{3}, 24)
+
+	seal := func(keys ...[]byte) []byte {
+		k, err := NewKeyring(keys)
+		if err != nil {
+			t.Fatalf("NewKeyring: %v", err)
+		}
+		data, err := k.Seal([]byte("secret"))
+		if err != nil {
+			t.Fatalf("Seal: %v", err)
+		}
+		return data
+	}
+	plain := []byte{recordMagic, 1, 2, 3}
+	sealedOld := seal(oldKey)
+	sealedNew := seal(newKey, oldKey)
+	sealedRemoved := seal(removedKey)
+	tampered := append([]byte(nil), sealedNew...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name        string
+		keys        [][]byte
+		data        []byte
+		want        []byte
+		wantErr     error
+		wantCurrent bool
+	}{
+		{"plain without keys", nil, plain, plain, nil, true},
+		{"plain with keys", [][]byte{newKey}, plain, plain, nil, false},
+		{"active key", [][]byte{newKey, oldKey}, sealedNew, []byte("secret"), nil, true},
+		{"rotated key", [][]byte{newKey, oldKey}, sealedOld, []byte("secret"), nil, false},
+		{"unknown key", [][]byte{newKey, oldKey}, sealedRemoved, nil, errUnknownKey, false},
+		{"unknown key without keys", nil, sealedRemoved, nil, errUnknownKey, false},
+		{"tampered", [][]byte{newKey, oldKey}, tampered, nil, errDecrypt, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := NewKeyring(tt.keys)
+			if err != nil {
+				t.Fatalf("NewKeyring: %v", err)
+			}
+
+			got, err := k.Open(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Open error = %v, want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Open = %q, want %q", got, tt.want)
+			}
+			if current := k.IsCurrent(tt.data); current != tt.wantCurrent {
+				t.Errorf("IsCurrent = %v, want %v", current, tt.wantCurrent)
+			}
+		})
+	}
+}
+
+func TestKeyringSealUsesActiveKey(t *testing.T) {
+	k, err := NewKeyring([][]byte{bytes.Repeat([]byte{2}, 16), bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	a, _ := k.Seal([]byte("secret"))
+	b, _ := k.Seal([]byte("secret"))
+	if bytes.Equal(a, b) {
+		t.Error("sealing twice gave the same output, nonces aren't random")
+	}
+	if !k.IsCurrent(a) {
+		t.Error("sealed value isn't current")
+	}
+}
+
+func TestNewKeyringInvalidKey(t *testing.T) {
+	if _, err := NewKeyring([][]byte{[]byte("short")}); err == nil {
+		t.Error("NewKeyring accepted a 5 byte key")
+	}
+}
+
+func TestStoreReencryptUnknownKey(t *testing.T) {
+	config := testStoreConfig(t)
+	config.EncryptionKeys = [][]byte{bytes.Repeat([]byte{3}, 24)}
+	s, err := NewStore(NewLogger("test"), config)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ctx := context.Background()
+	if err := s.SetMessage(ctx, testMessage("1", "2", "3", "100", "a"), time.Hour); err != nil {
+		t.Fatalf("SetMessage: %v", err)
+	}
+	if err := s.AddAttachments(ctx, "1", "2", "100", []*Attachment{{Filename: "a", Size: 1, Data: []byte("a")}}); err != nil {
+		t.Fatalf("AddAttachments: %v", err)
+	}
+	s.Close()
+
+	// the key is replaced instead of rotated
+	config.EncryptionKeys = [][]byte{bytes.Repeat([]byte{2}, 16)}
+	s, err = NewStore(NewLogger("test"), config)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.GetMessage(ctx, "1", "2", "100"); !errors.Is(err, errUnknownKey) {
+		t.Errorf("GetMessage error = %v, want errUnknownKey", err)
+	}
+	result, err := s.Reencrypt(ctx)
+	if err != nil {
+		t.Fatalf("Reencrypt: %v", err)
+	}
+	want := ReencryptResult{Undecryptable: 2}
+	if *result != want {
+		t.Errorf("Reencrypt = %+v, want %+v", *result, want)
+	}
+}
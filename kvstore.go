@@ -2,32 +2,176 @@ package stare
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/dgraph-io/badger"
 	"github.com/dgraph-io/badger/options"
+	"github.com/intrntsrfr/meido/pkg/utils"
 	"go.uber.org/zap"
 )
 
+// Store keeps members and messages in a badger database on disk.
 type Store struct {
-	db     *badger.DB
-	logger *ZapLogger
+	db      *badger.DB
+	blobs   *BlobStore
+	keyring *Keyring
+	config  *StoreConfig
+	logger  *ZapLogger
+
+	// written counts the size of the message records written since the
+	// store was opened
+	written compressionCounter
+
+	// usage counts what each guild stores, quotaMu makes sure only one
+	// guild is evicted from at a time
+	usage   usageCounter
+	quotaMu sync.Mutex
+
+	// mu is held for reading by every operation on db, so Close can wait for
+	// in-flight operations to finish before closing it
+	mu     sync.RWMutex
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// ErrStoreClosed is returned by operations on a store that has been closed.
+var ErrStoreClosed = errors.New("store is closed")
+
+// StoreConfig configures where a Store keeps its data, for how long, and how
+// often the value log is garbage collected.
+type StoreConfig struct {
+	// Dir is the directory badger keeps its files in
+	Dir string
+	// AttachmentDir is the directory attachment data is kept in
+	AttachmentDir string
+	// MessageTTL is how long messages are kept for unless the guild has its
+	// own retention
+	MessageTTL time.Duration
+	// MemberHistoryTTL is how long the history of a member is kept for after
+	// they leave a guild
+	MemberHistoryTTL time.Duration
+	// GCInterval is how often the value log is garbage collected
+	GCInterval time.Duration
+	// GCDiscardRatio is the fraction of a value log file that has to be stale
+	// before the file is rewritten
+	GCDiscardRatio float64
+	// EncryptionKeys are the keys messages and attachments are encrypted
+	// with. The first key is used for new values, the others only for reading
+	// values written before the key was rotated. Values are stored
+	// unencrypted if there are no keys.
+	EncryptionKeys [][]byte
+	// GuildMaxMessages and GuildMaxBytes are how many messages, and how many
+	// bytes of messages and attachments, a guild can store before its oldest
+	// messages are evicted. 0 is unlimited.
+	GuildMaxMessages int
+	GuildMaxBytes    int64
+}
+
+func DefaultStoreConfig() *StoreConfig {
+	return &StoreConfig{
+		Dir:              "./data",
+		AttachmentDir:    "./attachments",
+		MessageTTL:       24 * time.Hour,
+		MemberHistoryTTL: 30 * 24 * time.Hour,
+		GCInterval:       time.Hour,
+		GCDiscardRatio:   0.7,
+	}
+}
+
+// NewStoreConfig reads the store settings from config, using the defaults for
+// anything that is missing.
+func NewStoreConfig(config *utils.Config) (*StoreConfig, error) {
+	c := DefaultStoreConfig()
+	if dir := config.GetString("data_dir"); dir != "" {
+		c.Dir = dir
+	}
+	if dir := config.GetString("attachment_dir"); dir != "" {
+		c.AttachmentDir = dir
+	}
+
+	for key, dst := range map[string]*time.Duration{
+		"message_ttl":        &c.MessageTTL,
+		"member_history_ttl": &c.MemberHistoryTTL,
+		"gc_interval":        &c.GCInterval,
+	} {
+		v := config.GetString(key)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %w", key, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid %v: must be positive", key)
+		}
+		*dst = d
+	}
+
+	if v := config.GetString("gc_discard_ratio"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gc_discard_ratio: %w", err)
+		}
+		if ratio <= 0 || ratio >= 1 {
+			return nil, errors.New("invalid gc_discard_ratio: must be between 0 and 1")
+		}
+		c.GCDiscardRatio = ratio
+	}
+
+	keys, err := ParseKeys(config.GetStringSlice("encryption_keys"))
+	if err != nil {
+		return nil, err
+	}
+	c.EncryptionKeys = keys
+
+	if n := config.GetInt("guild_max_messages"); n > 0 {
+		c.GuildMaxMessages = n
+	}
+	if n := config.GetInt("guild_max_bytes"); n > 0 {
+		c.GuildMaxBytes = int64(n)
+	}
+	return c, nil
 }
 
-func NewStore(logger *ZapLogger) (*Store, error) {
+func NewStore(logger *ZapLogger, config *StoreConfig) (*Store, error) {
 	logger = logger.Named("kvstore").(*ZapLogger)
 	badgerLogger := &ZapLogger{
 		log: logger.Named("badger").(*ZapLogger).log.WithOptions(zap.AddCallerSkip(1)),
 	}
 
 	s := &Store{
+		config: config,
 		logger: logger,
+		done:   make(chan struct{}),
 	}
 
-	opts := badger.DefaultOptions("./data")
+	keyring, err := NewKeyring(config.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	s.keyring = keyring
+
+	blobs, err := NewBlobStore(config.AttachmentDir, keyring)
+	if err != nil {
+		s.logger.Info("failed to open attachment store", zap.Error(err))
+		return nil, err
+	}
+	s.blobs = blobs
+
+	opts := badger.DefaultOptions(config.Dir)
 	opts.Truncate = true
 	opts.ValueLogLoadingMode = options.FileIO
 	opts.Logger = badgerLogger
@@ -39,15 +183,52 @@ func NewStore(logger *ZapLogger) (*Store, error) {
 	}
 	s.db = db
 
-	go s.RunGC()
+	if err := s.migrateIndexes(); err != nil {
+		s.logger.Info("failed to migrate message index", zap.Error(err))
+		db.Close()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.runGC()
 
 	return s, nil
 }
 
+// Close stops the garbage collector, waits for in-flight operations to finish
+// and closes the database.
 func (s *Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
 	return s.db.Close()
 }
 
+func (s *Store) view(fn func(txn *badger.Txn) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	return s.db.View(fn)
+}
+
+func (s *Store) update(fn func(txn *badger.Txn) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	return s.db.Update(fn)
+}
+
 func encodeGob(v interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 	err := gob.NewEncoder(&buf).Encode(v)
@@ -62,7 +243,11 @@ func decodeGob(data []byte, v interface{}) error {
 	return gob.NewDecoder(buffer).Decode(v)
 }
 
-func (s *Store) SetMember(m *discordgo.Member) error {
+func (s *Store) SetMember(ctx context.Context, m *discordgo.Member) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	enc, err := encodeGob(m)
 	if err != nil {
 		s.logger.Error("failed to encode member", zap.Error(err))
@@ -70,15 +255,19 @@ func (s *Store) SetMember(m *discordgo.Member) error {
 	}
 
 	key := fmt.Sprintf("member:%v:%v", m.GuildID, m.User.ID)
-	return s.db.Update(func(txn *badger.Txn) error {
+	return s.update(func(txn *badger.Txn) error {
 		return txn.Set([]byte(key), enc)
 	})
 }
 
-func (s *Store) GetMember(gid, uid string) (*discordgo.Member, error) {
+func (s *Store) GetMember(ctx context.Context, gid, uid string) (*discordgo.Member, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	var member discordgo.Member
 	key := fmt.Sprintf("member:%v:%v", gid, uid)
-	if err := s.db.View(func(txn *badger.Txn) error {
+	if err := s.view(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
 		if err != nil {
 			return err
@@ -90,48 +279,112 @@ func (s *Store) GetMember(gid, uid string) (*discordgo.Member, error) {
 		}
 		return decodeGob(value, &member)
 	}); err != nil {
-		if err != badger.ErrKeyNotFound {
-			s.logger.Error("failed to read value", zap.Error(err))
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotFound
 		}
+		s.logger.Error("failed to read value", zap.Error(err))
 		return nil, err
 	}
 
 	return &member, nil
 }
 
-func (s *Store) DeleteMember(gid, uid string) error {
+func (s *Store) DeleteMember(ctx context.Context, gid, uid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	key := fmt.Sprintf("member:%v:%v", gid, uid)
-	return s.db.Update(func(txn *badger.Txn) error {
+	return s.update(func(txn *badger.Txn) error {
 		return txn.Delete([]byte(key))
 	})
 }
 
-func (s *Store) SetMessage(msg *DiscordMessage) error {
-	messageKey := fmt.Sprintf("message:%s:%s:%s", msg.Message.GuildID, msg.Message.ChannelID, msg.Message.ID)
-	enc, err := encodeGob(msg)
+func channelKey(gid, cid string) string {
+	return fmt.Sprintf("channel:%v:%v", gid, cid)
+}
+
+func (s *Store) SetChannel(ctx context.Context, c *discordgo.Channel) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	enc, err := encodeGob(copyChannel(c))
 	if err != nil {
-		return fmt.Errorf("failed to encode DiscordMessage: %w", err)
+		return err
 	}
 
-	indexKey := fmt.Sprintf("index:%s:%s:%s:%s", msg.Message.GuildID, msg.Message.Author.ID, msg.Message.Timestamp, msg.Message.ID)
-	indexValue := messageKey
+	key := channelKey(c.GuildID, c.ID)
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), enc)
+	})
+}
 
-	return s.db.Update(func(txn *badger.Txn) error {
-		entry := badger.NewEntry([]byte(messageKey), enc).WithTTL(24 * time.Hour)
-		if err := txn.SetEntry(entry); err != nil {
+func (s *Store) GetChannel(ctx context.Context, gid, cid string) (*discordgo.Channel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var channel discordgo.Channel
+	err := s.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(channelKey(gid, cid)))
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
 			return err
 		}
+		return decodeGob(value, &channel)
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		s.logger.Error("failed to read channel", zap.Error(err))
+		return nil, err
+	}
+	return &channel, nil
+}
+
+func (s *Store) DeleteChannel(ctx context.Context, gid, cid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-		indexEntry := badger.NewEntry([]byte(indexKey), []byte(indexValue)).WithTTL(24 * time.Hour)
-		return txn.SetEntry(indexEntry)
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(channelKey(gid, cid)))
 	})
 }
 
-func (s *Store) GetMessage(gid, cid, mid string) (*DiscordMessage, error) {
-	var message DiscordMessage
-	key := fmt.Sprintf("message:%v:%v:%v", gid, cid, mid)
-	if err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
+func roleKey(gid, rid string) string {
+	return fmt.Sprintf("role:%v:%v", gid, rid)
+}
+
+func (s *Store) SetRole(ctx context.Context, gid string, r *discordgo.Role) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	enc, err := encodeGob(r)
+	if err != nil {
+		return err
+	}
+
+	key := roleKey(gid, r.ID)
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), enc)
+	})
+}
+
+func (s *Store) GetRole(ctx context.Context, gid, rid string) (*discordgo.Role, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var role discordgo.Role
+	err := s.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(roleKey(gid, rid)))
 		if err != nil {
 			return err
 		}
@@ -139,71 +392,1144 @@ func (s *Store) GetMessage(gid, cid, mid string) (*DiscordMessage, error) {
 		if err != nil {
 			return err
 		}
-		return decodeGob(value, &message)
-	}); err != nil {
-		if err != badger.ErrKeyNotFound {
-			s.logger.Error("failed to read message", zap.Error(err))
-		}
+		return decodeGob(value, &role)
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		s.logger.Error("failed to read role", zap.Error(err))
 		return nil, err
 	}
+	return &role, nil
+}
 
-	return &message, nil
+func (s *Store) DeleteRole(ctx context.Context, gid, rid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(roleKey(gid, rid)))
+	})
 }
 
-func (s *Store) GetMessageLog(gid, uid string) ([]*DiscordMessage, error) {
-	prefix := fmt.Sprintf("index:%v:%v:", gid, uid)
-	var messages []*DiscordMessage
-	err := s.db.View(func(txn *badger.Txn) error {
+func voiceSessionKey(gid, uid string) string {
+	return fmt.Sprintf("voice:%v:%v", gid, uid)
+}
+
+func (s *Store) SetVoiceSession(ctx context.Context, gid, uid string, v *VoiceSession) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	enc, err := encodeGob(v)
+	if err != nil {
+		return err
+	}
+
+	key := voiceSessionKey(gid, uid)
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), enc)
+	})
+}
+
+func (s *Store) GetVoiceSession(ctx context.Context, gid, uid string) (*VoiceSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var session VoiceSession
+	err := s.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(voiceSessionKey(gid, uid)))
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return decodeGob(value, &session)
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		s.logger.Error("failed to read voice session", zap.Error(err))
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *Store) GetVoiceSessions(ctx context.Context, gid string) (map[string]*VoiceSession, error) {
+	sessions := make(map[string]*VoiceSession)
+	err := s.view(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 
-		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
-			item := it.Item()
-			var messageKey string
-			value, err := item.ValueCopy(nil)
+		prefix := []byte(voiceSessionKey(gid, ""))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			value, err := it.Item().ValueCopy(nil)
 			if err != nil {
-				s.logger.Error("failed to read value", zap.Error(err))
-				continue
+				return err
+			}
+			var session VoiceSession
+			if err := decodeGob(value, &session); err != nil {
+				return err
 			}
-			messageKey = string(value)
+			uid := strings.TrimPrefix(string(it.Item().Key()), string(prefix))
+			sessions[uid] = &session
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
 
-			var message DiscordMessage
-			err = s.db.View(func(txn *badger.Txn) error {
-				item, err := txn.Get([]byte(messageKey))
-				if err != nil {
-					return err
-				}
-				value, err := item.ValueCopy(nil)
-				if err != nil {
-					return err
-				}
-				return decodeGob(value, &message)
-			})
+func (s *Store) DeleteVoiceSession(ctx context.Context, gid, uid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(voiceSessionKey(gid, uid)))
+	})
+}
+
+func memberHistoryKey(gid, uid string) string {
+	return fmt.Sprintf("memberhistory:%v:%v", gid, uid)
+}
+
+func (s *Store) AddMemberSnapshot(ctx context.Context, m *discordgo.Member) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key := []byte(memberHistoryKey(m.GuildID, m.User.ID))
+	return s.update(func(txn *badger.Txn) error {
+		var history []*MemberSnapshot
+		var expiring bool
+		item, err := txn.Get(key)
+		switch {
+		case err == nil:
+			value, err := item.ValueCopy(nil)
 			if err != nil {
-				s.logger.Error("failed to read message", zap.Error(err))
-				continue
+				return err
 			}
+			if err := decodeGob(value, &history); err != nil {
+				return err
+			}
+			expiring = item.ExpiresAt() != 0
+		case err != badger.ErrKeyNotFound:
+			return err
+		}
 
-			messages = append(messages, &message)
+		history, added := appendSnapshot(history, newMemberSnapshot(m))
+		if !added && !expiring {
+			return nil
 		}
-		return nil
+
+		enc, err := encodeGob(history)
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, enc)
+	})
+}
+
+func (s *Store) GetMemberHistory(ctx context.Context, gid, uid string) ([]*MemberSnapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var history []*MemberSnapshot
+	err := s.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(memberHistoryKey(gid, uid)))
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return decodeGob(value, &history)
 	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		s.logger.Error("failed to read messages", zap.Error(err))
+		s.logger.Error("failed to read member history", zap.Error(err))
+		return nil, err
+	}
+	return history, nil
+}
+
+func (s *Store) ExpireMemberHistory(ctx context.Context, gid, uid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key := []byte(memberHistoryKey(gid, uid))
+	err := s.update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return txn.SetEntry(badger.NewEntry(key, value).WithTTL(s.config.MemberHistoryTTL))
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) GetMemberHistoryIDs(ctx context.Context, gid string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	return messages, err
+	var ids []string
+	err := s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(memberHistoryKey(gid, ""))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if it.Item().ExpiresAt() != 0 {
+				continue
+			}
+			ids = append(ids, strings.TrimPrefix(string(it.Item().Key()), string(prefix)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
 }
 
-func (s *Store) RunGC() {
-	gcTicker := time.NewTicker(time.Hour)
-	for range gcTicker.C {
-		for {
-			err := s.db.RunValueLogGC(0.7)
-			if err == badger.ErrNoRewrite {
-				break
+// SetMessage stores msg for ttl, or for the configured message TTL if ttl is
+// not positive. If the guild goes over its quota, its oldest messages are
+// evicted.
+func (s *Store) SetMessage(ctx context.Context, msg *DiscordMessage, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	messageKey := messageKey(msg.Message.GuildID, msg.Message.ChannelID, msg.Message.ID)
+
+	attachments, err := s.putBlobs(msg.Attachments)
+	if err != nil {
+		return err
+	}
+	stored := &DiscordMessage{Message: msg.Message, Attachments: attachments, Revisions: msg.Revisions}
+
+	enc, err := s.encodeMessage(stored)
+	if err != nil {
+		return fmt.Errorf("failed to encode DiscordMessage: %w", err)
+	}
+
+	id := sortableID(msg.Message.ID)
+	indexKeys := []string{
+		authorIndexPrefix(msg.Message.GuildID, msg.Message.Author.ID) + id,
+		channelIndexPrefix(msg.Message.GuildID, msg.Message.ChannelID) + id,
+		guildIndexPrefix(msg.Message.GuildID) + id,
+	}
+
+	if ttl <= 0 {
+		ttl = s.config.MessageTTL
+	}
+
+	gid := msg.Message.GuildID
+	size := int64(len(enc)) + attachmentsSize(stored.Attachments)
+	var messages int
+	var bytes int64
+	err = s.update(func(txn *badger.Txn) error {
+		entry := badger.NewEntry([]byte(messageKey), enc).WithTTL(ttl)
+		if err := txn.SetEntry(entry); err != nil {
+			return err
+		}
+
+		for _, indexKey := range indexKeys {
+			indexEntry := badger.NewEntry([]byte(indexKey), []byte(messageKey)).WithTTL(ttl)
+			if err := txn.SetEntry(indexEntry); err != nil {
+				return err
 			}
 		}
+
+		if err := setBlobRefs(txn, messageKey, stored.Attachments, ttl); err != nil {
+			return err
+		}
+		messages, bytes, err = setUsage(txn, gid, msg.Message.ID, size, ttl)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.usage.add(gid, messages, bytes)
+
+	// the message is stored even if evicting fails
+	if err := s.enforceQuota(ctx, gid); err != nil {
+		s.logger.Error("failed to enforce guild quota", zap.String("guild", gid), zap.Error(err))
+	}
+	return nil
+}
+
+func messageKey(gid, cid, mid string) string {
+	return fmt.Sprintf("message:%s:%s:%s", gid, cid, mid)
+}
+
+// encodeMessage encodes msg into a compressed record, encrypted with the
+// active key.
+func (s *Store) encodeMessage(msg *DiscordMessage) ([]byte, error) {
+	enc, err := msg.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	compressed := compress(enc)
+	s.written.add(len(enc), len(compressed))
+	return s.keyring.Seal(compressed)
+}
+
+func (s *Store) decodeMessage(value []byte, msg *DiscordMessage) error {
+	dec, err := s.keyring.Open(value)
+	if err != nil {
+		return err
+	}
+	dec, err = decompress(dec)
+	if err != nil {
+		return err
+	}
+	return msg.UnmarshalBinary(dec)
+}
+
+// putBlobs writes the data of attachments into the blob store, and returns
+// the attachments with only their hash left for storing in a record.
+func (s *Store) putBlobs(attachments []*Attachment) ([]*Attachment, error) {
+	var stored []*Attachment
+	for _, a := range attachments {
+		hash := a.Hash
+		if hash == "" {
+			var err error
+			hash, err = s.blobs.Put(a.Data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to store attachment: %w", err)
+			}
+		}
+		stored = append(stored, &Attachment{
+			Filename: a.Filename,
+			Size:     a.Size,
+			Hash:     hash,
+		})
+	}
+	return stored, nil
+}
+
+// setBlobRefs makes the message hold a reference to the blobs of its
+// attachments, expiring together with the message.
+func setBlobRefs(txn *badger.Txn, messageKey string, attachments []*Attachment, ttl time.Duration) error {
+	for _, a := range attachments {
+		refKey := fmt.Sprintf("blobref:%s:%s", a.Hash, messageKey)
+		if err := txn.SetEntry(badger.NewEntry([]byte(refKey), nil).WithTTL(ttl)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddAttachments adds attachments to a stored message. A message that was
+// deleted or purged while its attachments were downloaded fails with
+// ErrNotFound before any blob is written.
+func (s *Store) AddAttachments(ctx context.Context, gid, cid, mid string, attachments []*Attachment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := s.view(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(messageKey(gid, cid, mid)))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	stored, err := s.putBlobs(attachments)
+	if err != nil {
+		return err
+	}
+	return s.updateMessage(ctx, gid, cid, mid, stored, func(msg *DiscordMessage) error {
+		msg.Attachments = append(msg.Attachments, stored...)
+		return nil
+	})
+}
+
+func (s *Store) UpdateMessage(ctx context.Context, gid, cid, mid string, fn func(*DiscordMessage) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.updateMessage(ctx, gid, cid, mid, nil, fn)
+}
+
+// updateConflictRetries is how many times a message update that conflicted
+// with another write to the message is retried.
+const updateConflictRetries = 3
+
+// updateMessage changes a stored message with fn in one transaction, keeping
+// when it expires. added are the attachments fn adds, whose blobs are already
+// stored.
+func (s *Store) updateMessage(ctx context.Context, gid, cid, mid string, added []*Attachment, fn func(*DiscordMessage) error) error {
+	key := messageKey(gid, cid, mid)
+	var grown int64
+	update := func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		ttl := time.Until(time.Unix(int64(item.ExpiresAt()), 0))
+		if ttl <= 0 {
+			return badger.ErrKeyNotFound
+		}
+
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		var message DiscordMessage
+		if err := s.decodeMessage(value, &message); err != nil {
+			return err
+		}
+		if err := fn(&message); err != nil {
+			return err
+		}
+
+		enc, err := s.encodeMessage(&message)
+		if err != nil {
+			return err
+		}
+		if err := txn.SetEntry(badger.NewEntry([]byte(key), enc).WithTTL(ttl)); err != nil {
+			return err
+		}
+		if err := setBlobRefs(txn, key, added, ttl); err != nil {
+			return err
+		}
+
+		uk := []byte(usageKey(gid, mid))
+		prev, err := getUsage(txn, uk)
+		if err == badger.ErrKeyNotFound {
+			// stored before usage was tracked
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		grown = int64(len(enc)) - int64(len(value)) + attachmentsSize(added)
+		return txn.SetEntry(badger.NewEntry(uk, []byte(strconv.FormatInt(prev+grown, 10))).WithTTL(ttl))
+	}
+
+	var err error
+	for attempt := 0; attempt <= updateConflictRetries; attempt++ {
+		grown = 0
+		if err = s.update(update); err != badger.ErrConflict {
+			break
+		}
+	}
+	if err == badger.ErrKeyNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	s.usage.add(gid, 0, grown)
+	if err := s.enforceQuota(ctx, gid); err != nil {
+		s.logger.Error("failed to enforce guild quota", zap.String("guild", gid), zap.Error(err))
+	}
+	return nil
+}
+
+func (s *Store) GetMessage(ctx context.Context, gid, cid, mid string) (*DiscordMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var message *DiscordMessage
+	key := messageKey(gid, cid, mid)
+	if err := s.view(func(txn *badger.Txn) error {
+		var err error
+		message, err = s.getMessage(txn, []byte(key))
+		return err
+	}); err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		s.logger.Error("failed to read message", zap.Error(err))
+		return nil, err
+	}
+
+	s.loadAttachments(message)
+	return message, nil
+}
+
+// loadAttachments reads the data of the message attachments from the blob
+// store. Attachments whose data can't be read are dropped.
+func (s *Store) loadAttachments(msg *DiscordMessage) {
+	attachments := msg.Attachments[:0]
+	for _, a := range msg.Attachments {
+		if a.Hash != "" && len(a.Data) == 0 {
+			data, err := s.blobs.Get(a.Hash)
+			if err != nil {
+				s.logger.Error("failed to read attachment", zap.String("hash", a.Hash), zap.Error(err))
+				continue
+			}
+			a.Data = data
+		}
+		attachments = append(attachments, a)
+	}
+	msg.Attachments = attachments
+}
+
+func (s *Store) GetMessageLog(ctx context.Context, gid, uid string, q MessageQuery) ([]*DiscordMessage, error) {
+	return collectMessages(func(fn func(*DiscordMessage) error) error {
+		return s.WalkMessageLog(ctx, gid, uid, q, fn)
+	})
+}
+
+func (s *Store) WalkMessageLog(ctx context.Context, gid, uid string, q MessageQuery, fn func(*DiscordMessage) error) error {
+	return s.walkIndex(ctx, authorIndexPrefix(gid, uid), q, fn)
+}
+
+func (s *Store) GetChannelMessages(ctx context.Context, gid, cid string, q MessageQuery) ([]*DiscordMessage, error) {
+	return collectMessages(func(fn func(*DiscordMessage) error) error {
+		return s.walkIndex(ctx, channelIndexPrefix(gid, cid), q, fn)
+	})
+}
+
+func (s *Store) GetGuildMessages(ctx context.Context, gid string, q MessageQuery) ([]*DiscordMessage, error) {
+	return collectMessages(func(fn func(*DiscordMessage) error) error {
+		return s.walkIndex(ctx, guildIndexPrefix(gid), q, fn)
+	})
+}
+
+// walkIndex calls fn for the messages in the index with prefix selected by
+// q, resolving them in the same transaction as the index is read in.
+func (s *Store) walkIndex(ctx context.Context, prefix string, q MessageQuery, fn func(*DiscordMessage) error) error {
+	from, to, err := q.idRange()
+	if err != nil {
+		return err
+	}
+
+	err = s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		walked := 0
+		for it.Seek([]byte(prefix + from)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if q.Limit > 0 && walked >= q.Limit {
+				return nil
+			}
+
+			item := it.Item()
+			if to != "" && string(item.Key()[len(prefix):]) >= to {
+				return nil
+			}
+
+			messageKey, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			message, err := s.getMessage(txn, messageKey)
+			if err == badger.ErrKeyNotFound {
+				// the index outlived the message by a moment
+				continue
+			}
+			if err != nil {
+				s.logger.Error("failed to read message", zap.ByteString("key", messageKey), zap.Error(err))
+				continue
+			}
+
+			walked++
+			if err := fn(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("failed to read messages", zap.Error(err))
+	}
+	return err
+}
+
+func (s *Store) getMessage(txn *badger.Txn, key []byte) (*DiscordMessage, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	var message DiscordMessage
+	if err := s.decodeMessage(value, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// The message indexes have keys ending with the sortable ID of each message,
+// pointing to the message key. They expire together with the message.
+
+// authorIndexPrefix is the prefix of the index of the messages of a user in
+// a guild.
+func authorIndexPrefix(gid, uid string) string {
+	return fmt.Sprintf("index:author:%s:%s:", gid, uid)
+}
+
+// channelIndexPrefix is the prefix of the index of the messages in a
+// channel.
+func channelIndexPrefix(gid, cid string) string {
+	return fmt.Sprintf("index:channel:%s:%s:", gid, cid)
+}
+
+// guildIndexPrefix is the prefix of the index of all messages in a guild.
+func guildIndexPrefix(gid string) string {
+	return fmt.Sprintf("index:guild:%s:", gid)
+}
+
+// migrateIndexes moves the entries of the author index written before it was
+// keyed by message ID, which looked like index:<gid>:<uid>:<timestamp>:<mid>,
+// to their current keys.
+func (s *Store) migrateIndexes() error {
+	type legacyEntry struct {
+		key, value []byte
+		expiresAt  uint64
+	}
+	var legacy []legacyEntry
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("index:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if rest := item.Key()[len(prefix):]; len(rest) == 0 || rest[0] < '0' || rest[0] > '9' {
+				continue
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			legacy = append(legacy, legacyEntry{item.KeyCopy(nil), value, item.ExpiresAt()})
+		}
+		return nil
+	})
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, e := range legacy {
+		parts := strings.Split(string(e.key), ":")
+		if len(parts) < 5 {
+			continue
+		}
+		gid, uid, mid := parts[1], parts[2], parts[len(parts)-1]
+
+		if ttl := time.Until(time.Unix(int64(e.expiresAt), 0)); ttl > 0 {
+			key := authorIndexPrefix(gid, uid) + sortableID(mid)
+			if err := wb.SetEntry(badger.NewEntry([]byte(key), e.value).WithTTL(ttl)); err != nil {
+				return err
+			}
+		}
+		if err := wb.Delete(e.key); err != nil {
+			return err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	s.logger.Info("migrated message index", zap.Int("entries", len(legacy)))
+	return nil
+}
+
+func (s *Store) PurgeUser(ctx context.Context, gid, uid string) (*PurgeResult, error) {
+	result := &PurgeResult{}
+
+	type indexEntry struct {
+		gid        string
+		indexKey   []byte
+		messageKey []byte
+	}
+	var entries []indexEntry
+	var memberKeys [][]byte
+
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("index:author:")
+		if gid != "" {
+			prefix = []byte(authorIndexPrefix(gid, uid))
+		}
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// index:author:<gid>:<uid>:<id>
+			parts := strings.Split(string(it.Item().Key()), ":")
+			if len(parts) != 5 || parts[3] != uid {
+				continue
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, indexEntry{parts[2], it.Item().KeyCopy(nil), value})
+		}
+
+		for _, p := range []string{"member:", "memberhistory:", "voice:"} {
+			prefix := []byte(p)
+			if gid != "" {
+				prefix = []byte(p + gid + ":")
+			}
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				// member:<gid>:<uid>, memberhistory:<gid>:<uid> and
+				// voice:<gid>:<uid>
+				parts := strings.Split(string(it.Item().Key()), ":")
+				if len(parts) != 3 || parts[2] != uid {
+					continue
+				}
+				memberKeys = append(memberKeys, it.Item().KeyCopy(nil))
+				result.addGuild(parts[1])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]bool)
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		err := s.update(func(txn *badger.Txn) error {
+			message, err := s.deleteMessage(txn, e.messageKey)
+			if err == badger.ErrKeyNotFound {
+				return txn.Delete(e.indexKey)
+			}
+			if err != nil {
+				return err
+			}
+			for _, a := range message.Attachments {
+				if a.Hash != "" {
+					hashes[a.Hash] = true
+				}
+			}
+			result.Messages++
+			result.Attachments += len(message.Attachments)
+			result.addGuild(e.gid)
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to delete message %s: %w", e.messageKey, err)
+		}
+	}
+	s.usage.forget(result.Guilds...)
+
+	err = s.update(func(txn *badger.Txn) error {
+		for _, key := range memberKeys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to delete member: %w", err)
+	}
+	result.MemberRecords = len(memberKeys)
+
+	// a purge doesn't wait for the grace period, the data has to be gone
+	// even if a message is about to refer to it again
+	return result, s.deleteUnreferencedBlobs(hashes, 0)
+}
+
+// deleteMessage deletes the message stored under messageKey together with its
+// indexes, usage and attachment references, and returns it.
+func (s *Store) deleteMessage(txn *badger.Txn, messageKey []byte) (*DiscordMessage, error) {
+	message, err := s.getMessage(txn, messageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := message.Message
+	id := sortableID(msg.ID)
+	keys := []string{
+		string(messageKey),
+		authorIndexPrefix(msg.GuildID, msg.Author.ID) + id,
+		channelIndexPrefix(msg.GuildID, msg.ChannelID) + id,
+		guildIndexPrefix(msg.GuildID) + id,
+		usageKey(msg.GuildID, msg.ID),
+	}
+	for _, a := range message.Attachments {
+		if a.Hash != "" {
+			keys = append(keys, fmt.Sprintf("blobref:%s:%s", a.Hash, messageKey))
+		}
+	}
+	for _, key := range keys {
+		if err := txn.Delete([]byte(key)); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+// deleteUnreferencedBlobs deletes the attachments with the given hashes.
+// Attachments that other messages still refer to, or that were written less
+// than grace ago, are left for the garbage collector.
+func (s *Store) deleteUnreferencedBlobs(hashes map[string]bool, grace time.Duration) error {
+	for hash := range hashes {
+		if grace > 0 {
+			modTime, err := s.blobs.ModTime(hash)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if time.Since(modTime) < grace {
+				continue
+			}
+		}
+
+		referenced, err := s.blobReferenced(hash)
+		if err != nil {
+			return err
+		}
+		if referenced {
+			continue
+		}
+		if err := s.blobs.Delete(hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete attachment %v: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+// StoreStats describes the messages and attachments in a store.
+type StoreStats struct {
+	Messages        int
+	MessageBytes    CompressionStats
+	Attachments     int
+	AttachmentBytes CompressionStats
+}
+
+// Stats goes through every stored message and attachment to sum up their
+// sizes before and after compression.
+func (s *Store) Stats(ctx context.Context) (*StoreStats, error) {
+	stats := &StoreStats{}
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("message:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			stored, err := s.keyring.Open(value)
+			if err != nil {
+				return err
+			}
+			raw, err := decompress(stored)
+			if err != nil {
+				return err
+			}
+			stats.Messages++
+			stats.MessageBytes.add(len(raw), len(stored))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.blobs.Walk(func(hash string, _ time.Time) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		size, stored, err := s.blobs.Stat(hash)
+		if err != nil {
+			return err
+		}
+		stats.Attachments++
+		stats.AttachmentBytes.add(size, stored)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CompressionStats returns the sizes of the messages and attachments written
+// since the store was opened, before and after compression.
+func (s *Store) CompressionStats() (messages, attachments CompressionStats) {
+	return s.written.stats(), s.blobs.CompressionStats()
+}
+
+// Encrypted reports whether new values are encrypted.
+func (s *Store) Encrypted() bool {
+	return s.keyring.Enabled()
+}
+
+// ReencryptResult describes what Reencrypt rewrote.
+type ReencryptResult struct {
+	Messages    int
+	Attachments int
+	// Undecryptable counts the messages and attachments that are encrypted
+	// with a key that isn't configured anymore, or can't be decrypted. They
+	// are left as they are.
+	Undecryptable int
+}
+
+// Reencrypt rewrites the messages and attachments that are not encrypted with
+// the active key, keeping the remaining TTL of each message. The old values
+// stay in the value log until it is garbage collected.
+func (s *Store) Reencrypt(ctx context.Context) (*ReencryptResult, error) {
+	result := &ReencryptResult{}
+	var keys [][]byte
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("message:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !s.keyring.IsCurrent(value) {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		err := s.update(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			ttl := time.Until(time.Unix(int64(item.ExpiresAt()), 0))
+			if ttl <= 0 {
+				return badger.ErrKeyNotFound
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			dec, err := s.keyring.Open(value)
+			if err != nil {
+				return err
+			}
+			enc, err := s.keyring.Seal(dec)
+			if err != nil {
+				return err
+			}
+			return txn.SetEntry(badger.NewEntry(key, enc).WithTTL(ttl))
+		})
+		switch {
+		case err == badger.ErrKeyNotFound:
+			// expired since it was listed
+			continue
+		case errors.Is(err, errUnknownKey) || errors.Is(err, errDecrypt):
+			result.Undecryptable++
+			s.logger.Error("failed to decrypt message", zap.ByteString("key", key), zap.Error(err))
+			continue
+		case err != nil:
+			return result, fmt.Errorf("failed to re-encrypt %s: %w", key, err)
+		}
+		result.Messages++
+	}
+	if result.Messages > 0 {
+		s.collectGarbage()
+	}
+
+	err = s.blobs.Walk(func(hash string, _ time.Time) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rewritten, err := s.blobs.Reencrypt(hash)
+		if errors.Is(err, errUnknownKey) || errors.Is(err, errDecrypt) {
+			result.Undecryptable++
+			s.logger.Error("failed to decrypt attachment", zap.String("hash", hash), zap.Error(err))
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt attachment %v: %w", hash, err)
+		}
+		if rewritten {
+			result.Attachments++
+		}
+		return nil
+	})
+	return result, err
+}
+
+// runGC garbage collects the value log every GC interval until the store is
+// closed.
+func (s *Store) runGC() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.collectGarbage()
+			s.sweepBlobs()
+			s.usage.reset()
+		}
+	}
+}
+
+func (s *Store) collectGarbage() {
+	before := s.valueLogSize()
+	rewrites := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		err := s.db.RunValueLogGC(s.config.GCDiscardRatio)
+		if err == badger.ErrNoRewrite {
+			break
+		}
+		if err != nil {
+			s.logger.Error("failed to garbage collect value log", zap.Error(err))
+			break
+		}
+		rewrites++
+	}
+
+	if rewrites > 0 {
+		s.logger.Info("garbage collected value log",
+			zap.Int("rewrites", rewrites),
+			zap.Int64("reclaimed", before-s.valueLogSize()),
+		)
+	}
+}
+
+// blobGracePeriod is how long a new blob is kept around without references,
+// so blobs aren't swept between being written and their reference being set.
+// Writing a blob that already exists touches it, and references are set in a
+// separate transaction, so nothing but this grace period keeps a sweep from
+// deleting a blob that a new message is about to refer to. Attachments have to
+// be referenced within this long of being written. Eviction waits for it too,
+// a purge doesn't.
+const blobGracePeriod = 10 * time.Minute
+
+// sweepBlobs deletes the blobs that are no longer referenced by any message.
+func (s *Store) sweepBlobs() {
+	var swept int
+	err := s.blobs.Walk(func(hash string, modTime time.Time) error {
+		select {
+		case <-s.done:
+			return filepath.SkipAll
+		default:
+		}
+
+		if time.Since(modTime) < blobGracePeriod {
+			return nil
+		}
+
+		referenced, err := s.blobReferenced(hash)
+		if err != nil || referenced {
+			return err
+		}
+		if err := s.blobs.Delete(hash); err != nil {
+			return err
+		}
+		swept++
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("failed to sweep attachments", zap.Error(err))
+	}
+	if swept > 0 {
+		s.logger.Info("swept unreferenced attachments", zap.Int("count", swept))
+	}
+}
+
+func (s *Store) blobReferenced(hash string) (bool, error) {
+	prefix := []byte(fmt.Sprintf("blobref:%s:", hash))
+	var referenced bool
+	err := s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		it.Seek(prefix)
+		referenced = it.ValidForPrefix(prefix)
+		return nil
+	})
+	return referenced, err
+}
+
+// valueLogSize returns the size in bytes of the value log files on disk.
+func (s *Store) valueLogSize() int64 {
+	files, err := filepath.Glob(filepath.Join(s.config.Dir, "*.vlog"))
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			size += info.Size()
+		}
 	}
+	return size
 }
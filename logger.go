@@ -13,7 +13,7 @@ type ZapLogger struct {
 	log *zap.Logger
 }
 
-func newLogger(name string) *ZapLogger {
+func NewLogger(name string) *ZapLogger {
 	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:        "time",
 		LevelKey:       "level",
@@ -0,0 +1,62 @@
+package stare
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxMemberSnapshots is the number of snapshots kept per member, older ones
+// are dropped.
+const maxMemberSnapshots = 100
+
+// MemberSnapshot is how a member looked at some point in time.
+type MemberSnapshot struct {
+	Timestamp  time.Time
+	Username   string
+	GlobalName string
+	Nick       string
+	// Avatar is the guild avatar of the member, not their user avatar
+	Avatar string
+	Roles  []string
+}
+
+func newMemberSnapshot(m *discordgo.Member) *MemberSnapshot {
+	s := &MemberSnapshot{
+		Timestamp: time.Now().UTC(),
+		Nick:      m.Nick,
+		Avatar:    m.Avatar,
+		Roles:     append([]string(nil), m.Roles...),
+	}
+	if m.User != nil {
+		s.Username = m.User.Username
+		s.GlobalName = m.User.GlobalName
+	}
+	sort.Strings(s.Roles)
+	return s
+}
+
+// sameAs reports whether two snapshots look the same, ignoring when they were
+// taken.
+func (s *MemberSnapshot) sameAs(o *MemberSnapshot) bool {
+	return s.Username == o.Username &&
+		s.GlobalName == o.GlobalName &&
+		s.Nick == o.Nick &&
+		s.Avatar == o.Avatar &&
+		slices.Equal(s.Roles, o.Roles)
+}
+
+// appendSnapshot adds snapshot to history unless it looks the same as the
+// last one, and reports whether it was added.
+func appendSnapshot(history []*MemberSnapshot, snapshot *MemberSnapshot) ([]*MemberSnapshot, bool) {
+	if len(history) > 0 && history[len(history)-1].sameAs(snapshot) {
+		return history, false
+	}
+	history = append(history, snapshot)
+	if len(history) > maxMemberSnapshots {
+		history = history[len(history)-maxMemberSnapshots:]
+	}
+	return history, true
+}
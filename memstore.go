@@ -0,0 +1,604 @@
+package stare
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// MemoryStore keeps members and messages in memory. Messages expire after
+// their TTL just like in Store, but nothing survives a restart.
+type MemoryStore struct {
+	config *StoreConfig
+
+	mu       sync.RWMutex
+	members  map[string]*discordgo.Member
+	channels map[string]*discordgo.Channel
+	roles    map[string]*discordgo.Role
+	voice    map[string]*VoiceSession
+	messages map[string]*memoryMessage
+	history  map[string]*memoryHistory
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type memoryMessage struct {
+	msg       *DiscordMessage
+	expiresAt time.Time
+	// size is the size of the message record plus its attachments, counted
+	// towards the guild quota
+	size int64
+}
+
+func memoryMessageSize(msg *DiscordMessage) int64 {
+	stored := &DiscordMessage{Message: msg.Message, Revisions: msg.Revisions}
+	enc, err := stored.MarshalBinary()
+	if err != nil {
+		return 0
+	}
+	return int64(len(enc)) + attachmentsSize(msg.Attachments)
+}
+
+type memoryHistory struct {
+	snapshots []*MemberSnapshot
+	// expiresAt is zero while the member is in the guild
+	expiresAt time.Time
+}
+
+func (h *memoryHistory) expired(now time.Time) bool {
+	return !h.expiresAt.IsZero() && now.After(h.expiresAt)
+}
+
+func NewMemoryStore(config *StoreConfig) *MemoryStore {
+	s := &MemoryStore{
+		config:   config,
+		members:  make(map[string]*discordgo.Member),
+		channels: make(map[string]*discordgo.Channel),
+		roles:    make(map[string]*discordgo.Role),
+		voice:    make(map[string]*VoiceSession),
+		messages: make(map[string]*memoryMessage),
+		history:  make(map[string]*memoryHistory),
+		done:     make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.runExpiry()
+
+	return s
+}
+
+// Close stops removing expired messages. Closing it again does nothing.
+func (s *MemoryStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+	return nil
+}
+
+// runExpiry removes expired messages every GC interval until the store is
+// closed.
+func (s *MemoryStore) runExpiry() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, m := range s.messages {
+				if now.After(m.expiresAt) {
+					delete(s.messages, key)
+				}
+			}
+			for key, h := range s.history {
+				if h.expired(now) {
+					delete(s.history, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func copyMember(m *discordgo.Member) *discordgo.Member {
+	c := *m
+	if m.User != nil {
+		u := *m.User
+		c.User = &u
+	}
+	c.Roles = append([]string(nil), m.Roles...)
+	return &c
+}
+
+func copyDiscordMessage(msg *DiscordMessage) *DiscordMessage {
+	m := *msg.Message
+	return &DiscordMessage{
+		Message:     &m,
+		Attachments: append([]*Attachment(nil), msg.Attachments...),
+		Revisions:   append([]*MessageRevision(nil), msg.Revisions...),
+	}
+}
+
+func (s *MemoryStore) SetMember(ctx context.Context, m *discordgo.Member) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.members[fmt.Sprintf("%v:%v", m.GuildID, m.User.ID)] = copyMember(m)
+	return nil
+}
+
+func (s *MemoryStore) GetMember(ctx context.Context, gid, uid string) (*discordgo.Member, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.members[fmt.Sprintf("%v:%v", gid, uid)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyMember(m), nil
+}
+
+func (s *MemoryStore) DeleteMember(ctx context.Context, gid, uid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.members, fmt.Sprintf("%v:%v", gid, uid))
+	return nil
+}
+
+func (s *MemoryStore) SetChannel(ctx context.Context, c *discordgo.Channel) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[fmt.Sprintf("%v:%v", c.GuildID, c.ID)] = copyChannel(c)
+	return nil
+}
+
+func (s *MemoryStore) GetChannel(ctx context.Context, gid, cid string) (*discordgo.Channel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.channels[fmt.Sprintf("%v:%v", gid, cid)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyChannel(c), nil
+}
+
+func (s *MemoryStore) DeleteChannel(ctx context.Context, gid, cid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.channels, fmt.Sprintf("%v:%v", gid, cid))
+	return nil
+}
+
+func (s *MemoryStore) SetRole(ctx context.Context, gid string, r *discordgo.Role) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	role := *r
+	s.roles[fmt.Sprintf("%v:%v", gid, r.ID)] = &role
+	return nil
+}
+
+func (s *MemoryStore) GetRole(ctx context.Context, gid, rid string) (*discordgo.Role, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.roles[fmt.Sprintf("%v:%v", gid, rid)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	role := *r
+	return &role, nil
+}
+
+func (s *MemoryStore) DeleteRole(ctx context.Context, gid, rid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.roles, fmt.Sprintf("%v:%v", gid, rid))
+	return nil
+}
+
+func (s *MemoryStore) SetVoiceSession(ctx context.Context, gid, uid string, v *VoiceSession) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := *v
+	s.voice[fmt.Sprintf("%v:%v", gid, uid)] = &session
+	return nil
+}
+
+func (s *MemoryStore) GetVoiceSession(ctx context.Context, gid, uid string) (*VoiceSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.voice[fmt.Sprintf("%v:%v", gid, uid)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	session := *v
+	return &session, nil
+}
+
+func (s *MemoryStore) GetVoiceSessions(ctx context.Context, gid string) (map[string]*VoiceSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sessions := make(map[string]*VoiceSession)
+	for key, v := range s.voice {
+		g, u, _ := strings.Cut(key, ":")
+		if g != gid {
+			continue
+		}
+		session := *v
+		sessions[u] = &session
+	}
+	return sessions, nil
+}
+
+func (s *MemoryStore) DeleteVoiceSession(ctx context.Context, gid, uid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.voice, fmt.Sprintf("%v:%v", gid, uid))
+	return nil
+}
+
+func (s *MemoryStore) AddMemberSnapshot(ctx context.Context, m *discordgo.Member) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := fmt.Sprintf("%v:%v", m.GuildID, m.User.ID)
+	h, ok := s.history[key]
+	if !ok || h.expired(time.Now()) {
+		h = &memoryHistory{}
+		s.history[key] = h
+	}
+	h.snapshots, _ = appendSnapshot(h.snapshots, newMemberSnapshot(m))
+	h.expiresAt = time.Time{}
+	return nil
+}
+
+func (s *MemoryStore) GetMemberHistory(ctx context.Context, gid, uid string) ([]*MemberSnapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.history[fmt.Sprintf("%v:%v", gid, uid)]
+	if !ok || h.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return append([]*MemberSnapshot(nil), h.snapshots...), nil
+}
+
+func (s *MemoryStore) ExpireMemberHistory(ctx context.Context, gid, uid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.history[fmt.Sprintf("%v:%v", gid, uid)]; ok {
+		h.expiresAt = time.Now().Add(s.config.MemberHistoryTTL)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetMemberHistoryIDs(ctx context.Context, gid string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ids []string
+	for key, h := range s.history {
+		g, uid, _ := strings.Cut(key, ":")
+		if g == gid && h.expiresAt.IsZero() {
+			ids = append(ids, uid)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *MemoryStore) PurgeUser(ctx context.Context, gid, uid string) (*PurgeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &PurgeResult{}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, m := range s.messages {
+		msg := m.msg.Message
+		if msg.Author.ID != uid || (gid != "" && msg.GuildID != gid) {
+			continue
+		}
+		delete(s.messages, key)
+		result.Messages++
+		result.Attachments += len(m.msg.Attachments)
+		result.addGuild(msg.GuildID)
+	}
+	for key, m := range s.members {
+		if m.User.ID != uid || (gid != "" && m.GuildID != gid) {
+			continue
+		}
+		delete(s.members, key)
+		result.MemberRecords++
+		result.addGuild(m.GuildID)
+	}
+	for key := range s.history {
+		g, u, _ := strings.Cut(key, ":")
+		if u != uid || (gid != "" && g != gid) {
+			continue
+		}
+		delete(s.history, key)
+		result.MemberRecords++
+		result.addGuild(g)
+	}
+	for key := range s.voice {
+		g, u, _ := strings.Cut(key, ":")
+		if u != uid || (gid != "" && g != gid) {
+			continue
+		}
+		delete(s.voice, key)
+		result.MemberRecords++
+		result.addGuild(g)
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) SetMessage(ctx context.Context, msg *DiscordMessage, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		ttl = s.config.MessageTTL
+	}
+
+	key := fmt.Sprintf("%v:%v:%v", msg.Message.GuildID, msg.Message.ChannelID, msg.Message.ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[key] = &memoryMessage{
+		msg:       copyDiscordMessage(msg),
+		expiresAt: time.Now().Add(ttl),
+		size:      memoryMessageSize(msg),
+	}
+	s.enforceQuota(msg.Message.GuildID)
+	return nil
+}
+
+// guildMessages returns the keys of the stored messages of a guild and how
+// much they add up to. s.mu must be held.
+func (s *MemoryStore) guildMessages(gid string) ([]string, usageCount) {
+	now := time.Now()
+	var keys []string
+	var total usageCount
+	for key, m := range s.messages {
+		if m.msg.Message.GuildID != gid || now.After(m.expiresAt) {
+			continue
+		}
+		keys = append(keys, key)
+		total.messages++
+		total.bytes += m.size
+	}
+	return keys, total
+}
+
+// enforceQuota evicts the oldest messages of a guild that is over its quota,
+// the same way Store does. s.mu must be held for writing.
+func (s *MemoryStore) enforceQuota(gid string) {
+	if !s.config.hasQuota() {
+		return
+	}
+	keys, total := s.guildMessages(gid)
+	if !s.config.overQuota(total.messages, total.bytes, 1, 1) {
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return sortableID(s.messages[keys[i]].msg.Message.ID) < sortableID(s.messages[keys[j]].msg.Message.ID)
+	})
+	for _, key := range keys {
+		if !s.config.overQuota(total.messages, total.bytes, quotaLowWaterNum, quotaLowWaterDenom) {
+			break
+		}
+		total.messages--
+		total.bytes -= s.messages[key].size
+		delete(s.messages, key)
+	}
+}
+
+func (s *MemoryStore) GuildUsage(ctx context.Context, gid string) (*GuildUsage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, total := s.guildMessages(gid)
+	return s.config.guildUsage(total.messages, total.bytes), nil
+}
+
+func (s *MemoryStore) GetMessage(ctx context.Context, gid, cid, mid string) (*DiscordMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.messages[fmt.Sprintf("%v:%v:%v", gid, cid, mid)]
+	if !ok || time.Now().After(m.expiresAt) {
+		return nil, ErrNotFound
+	}
+	return copyDiscordMessage(m.msg), nil
+}
+
+func (s *MemoryStore) GetMessageLog(ctx context.Context, gid, uid string, q MessageQuery) ([]*DiscordMessage, error) {
+	return collectMessages(func(fn func(*DiscordMessage) error) error {
+		return s.WalkMessageLog(ctx, gid, uid, q, fn)
+	})
+}
+
+func (s *MemoryStore) WalkMessageLog(ctx context.Context, gid, uid string, q MessageQuery, fn func(*DiscordMessage) error) error {
+	return s.walkMessages(ctx, q, func(m *discordgo.Message) bool {
+		return m.GuildID == gid && m.Author.ID == uid
+	}, fn)
+}
+
+func (s *MemoryStore) GetChannelMessages(ctx context.Context, gid, cid string, q MessageQuery) ([]*DiscordMessage, error) {
+	return collectMessages(func(fn func(*DiscordMessage) error) error {
+		return s.walkMessages(ctx, q, func(m *discordgo.Message) bool {
+			return m.GuildID == gid && m.ChannelID == cid
+		}, fn)
+	})
+}
+
+func (s *MemoryStore) GetGuildMessages(ctx context.Context, gid string, q MessageQuery) ([]*DiscordMessage, error) {
+	return collectMessages(func(fn func(*DiscordMessage) error) error {
+		return s.walkMessages(ctx, q, func(m *discordgo.Message) bool {
+			return m.GuildID == gid
+		}, fn)
+	})
+}
+
+// walkMessages calls fn for the messages that match and are selected by q,
+// oldest first.
+func (s *MemoryStore) walkMessages(ctx context.Context, q MessageQuery, match func(*discordgo.Message) bool, fn func(*DiscordMessage) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	from, to, err := q.idRange()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var messages []*DiscordMessage
+	s.mu.RLock()
+	for _, m := range s.messages {
+		if now.After(m.expiresAt) || !match(m.msg.Message) {
+			continue
+		}
+		id := sortableID(m.msg.Message.ID)
+		if id < from || (to != "" && id >= to) {
+			continue
+		}
+		messages = append(messages, copyDiscordMessage(m.msg))
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(messages, func(i, j int) bool {
+		return sortableID(messages[i].Message.ID) < sortableID(messages[j].Message.ID)
+	})
+	if q.Limit > 0 && len(messages) > q.Limit {
+		messages = messages[:q.Limit]
+	}
+
+	for _, msg := range messages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddAttachments(ctx context.Context, gid, cid, mid string, attachments []*Attachment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[fmt.Sprintf("%v:%v:%v", gid, cid, mid)]
+	if !ok || time.Now().After(m.expiresAt) {
+		return ErrNotFound
+	}
+	m.msg.Attachments = append(m.msg.Attachments, attachments...)
+	m.size += attachmentsSize(attachments)
+	s.enforceQuota(gid)
+	return nil
+}
+
+func (s *MemoryStore) UpdateMessage(ctx context.Context, gid, cid, mid string, fn func(*DiscordMessage) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[fmt.Sprintf("%v:%v:%v", gid, cid, mid)]
+	if !ok || time.Now().After(m.expiresAt) {
+		return ErrNotFound
+	}
+	msg := copyDiscordMessage(m.msg)
+	if err := fn(msg); err != nil {
+		return err
+	}
+	m.msg = msg
+	m.size = memoryMessageSize(msg)
+	s.enforceQuota(gid)
+	return nil
+}
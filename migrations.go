@@ -0,0 +1,125 @@
+package stare
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is a single versioned schema change. Files in the migrations
+// directory are named <version>_<name>.sql and are applied in version order.
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+func loadMigrations() ([]*migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []*migration
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		versionStr, name, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name: %v", e.Name())
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version: %v", e.Name())
+		}
+
+		query, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, &migration{
+			version: version,
+			name:    name,
+			query:   string(query),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// migrate brings the schema of db up to date, applying every migration that
+// has not been recorded in the schema_migrations table yet.
+func migrate(db *sqlx.DB) error {
+	_, err := db.Exec(`create table if not exists schema_migrations
+(
+    version    integer   not null primary key,
+    name       text      not null,
+    applied_at timestamp not null
+);`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("failed to apply migration %v_%v: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// The migrations that add the tables read by DB methods, so a database that
+// is read without being migrated can be checked for them.
+const (
+	guildRevisionMigration = 2
+	purgeAuditMigration    = 8
+)
+
+// schemaVersion returns the version of the newest migration applied to db.
+func schemaVersion(db *sqlx.DB) (int, error) {
+	var version int
+	err := db.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	return version, err
+}
+
+func applyMigration(db *sqlx.DB, m *migration) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.query); err != nil {
+		return err
+	}
+	_, err = tx.Exec(tx.Rebind("INSERT INTO schema_migrations(version, name, applied_at) VALUES(?, ?, ?)"),
+		m.version, m.name, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,10 @@
+create table guild
+(
+    id             text not null primary key,
+    msg_edit_log   text default '' not null,
+    msg_delete_log text default '' not null,
+    ban_log        text default '' not null,
+    unban_log      text default '' not null,
+    join_log       text default '' not null,
+    leave_log      text default '' not null
+);
@@ -0,0 +1,11 @@
+create table guild_revision
+(
+    guild_id   text      not null references guild (id),
+    revision   integer   not null,
+    actor_id   text      not null,
+    field      text      not null,
+    old_value  text      not null,
+    new_value  text      not null,
+    created_at timestamp not null,
+    primary key (guild_id, revision)
+);
@@ -0,0 +1,2 @@
+alter table guild
+    add column message_retention integer default 0 not null;
@@ -0,0 +1,2 @@
+alter table guild
+    add column member_update_log text default '' not null;
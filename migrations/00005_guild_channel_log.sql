@@ -0,0 +1,2 @@
+alter table guild
+    add column channel_log text default '' not null;
@@ -0,0 +1,2 @@
+alter table guild
+    add column role_log text default '' not null;
@@ -0,0 +1,2 @@
+alter table guild
+    add column voice_log text default '' not null;
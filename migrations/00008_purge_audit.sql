@@ -0,0 +1,9 @@
+create table purge_audit
+(
+    guild_id   text      not null,
+    user_id    text      not null,
+    actor_id   text      not null,
+    created_at timestamp not null
+);
+
+create index purge_audit_guild_id on purge_audit (guild_id);
@@ -0,0 +1,89 @@
+package stare
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// permissionNames are the names Discord shows for permission bits, in the
+// order they are listed in the Discord client.
+var permissionNames = []struct {
+	bit  int64
+	name string
+}{
+	{discordgo.PermissionAdministrator, "Administrator"},
+	{discordgo.PermissionViewChannel, "View Channels"},
+	{discordgo.PermissionManageChannels, "Manage Channels"},
+	{discordgo.PermissionManageRoles, "Manage Roles"},
+	{discordgo.PermissionManageEmojis, "Manage Expressions"},
+	{discordgo.PermissionViewAuditLogs, "View Audit Log"},
+	{discordgo.PermissionViewGuildInsights, "View Server Insights"},
+	{discordgo.PermissionManageWebhooks, "Manage Webhooks"},
+	{discordgo.PermissionManageServer, "Manage Server"},
+	{discordgo.PermissionCreateInstantInvite, "Create Invite"},
+	{discordgo.PermissionChangeNickname, "Change Nickname"},
+	{discordgo.PermissionManageNicknames, "Manage Nicknames"},
+	{discordgo.PermissionKickMembers, "Kick Members"},
+	{discordgo.PermissionBanMembers, "Ban Members"},
+	{discordgo.PermissionModerateMembers, "Timeout Members"},
+	{discordgo.PermissionSendMessages, "Send Messages"},
+	{discordgo.PermissionSendMessagesInThreads, "Send Messages in Threads"},
+	{discordgo.PermissionCreatePublicThreads, "Create Public Threads"},
+	{discordgo.PermissionCreatePrivateThreads, "Create Private Threads"},
+	{discordgo.PermissionEmbedLinks, "Embed Links"},
+	{discordgo.PermissionAttachFiles, "Attach Files"},
+	{discordgo.PermissionAddReactions, "Add Reactions"},
+	{discordgo.PermissionUseExternalEmojis, "Use External Emoji"},
+	{discordgo.PermissionUseExternalStickers, "Use External Stickers"},
+	{discordgo.PermissionMentionEveryone, "Mention Everyone"},
+	{discordgo.PermissionManageMessages, "Manage Messages"},
+	{discordgo.PermissionManageThreads, "Manage Threads"},
+	{discordgo.PermissionReadMessageHistory, "Read Message History"},
+	{discordgo.PermissionSendTTSMessages, "Send Text-to-Speech Messages"},
+	{discordgo.PermissionUseSlashCommands, "Use Application Commands"},
+	{discordgo.PermissionVoiceConnect, "Connect"},
+	{discordgo.PermissionVoiceSpeak, "Speak"},
+	{discordgo.PermissionVoiceStreamVideo, "Video"},
+	{discordgo.PermissionUseActivities, "Use Activities"},
+	{discordgo.PermissionVoiceUseVAD, "Use Voice Activity"},
+	{discordgo.PermissionVoicePrioritySpeaker, "Priority Speaker"},
+	{discordgo.PermissionVoiceMuteMembers, "Mute Members"},
+	{discordgo.PermissionVoiceDeafenMembers, "Deafen Members"},
+	{discordgo.PermissionVoiceMoveMembers, "Move Members"},
+	{discordgo.PermissionVoiceRequestToSpeak, "Request to Speak"},
+	{discordgo.PermissionManageEvents, "Manage Events"},
+}
+
+// permissionList returns the names of the permissions set in bits. Bits
+// without a known name are listed by value.
+func permissionList(bits int64) []string {
+	var names []string
+	for _, p := range permissionNames {
+		if bits&p.bit != 0 {
+			names = append(names, p.name)
+			bits &^= p.bit
+		}
+	}
+	for i := 0; i < 64; i++ {
+		if bit := int64(1) << i; bits&bit != 0 {
+			names = append(names, fmt.Sprintf("Unknown (1 << %v)", i))
+		}
+	}
+	return names
+}
+
+// formatPermissions names the permissions set in bits.
+func formatPermissions(bits int64) string {
+	if bits == 0 {
+		return "None"
+	}
+	return strings.Join(permissionList(bits), ", ")
+}
+
+// diffPermissions returns the permissions that are set in cur but not in
+// prev, and the ones that are set in prev but not in cur.
+func diffPermissions(prev, cur int64) (added, removed int64) {
+	return cur &^ prev, prev &^ cur
+}
@@ -0,0 +1,331 @@
+package stare
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"go.uber.org/zap"
+)
+
+// When a guild goes over its quota, its oldest messages are evicted until it
+// is back at 90% of the quota, so a guild that stays at its quota doesn't
+// have to be evicted from on every message.
+const (
+	quotaLowWaterNum   = 9
+	quotaLowWaterDenom = 10
+
+	// evictBatchSize is how many messages are evicted in one transaction
+	evictBatchSize = 100
+)
+
+// GuildUsage is how much a guild stores, and the quotas it is held to. A
+// quota of 0 is unlimited.
+type GuildUsage struct {
+	Messages    int
+	Bytes       int64
+	MaxMessages int
+	MaxBytes    int64
+}
+
+func (c *StoreConfig) hasQuota() bool {
+	return c.GuildMaxMessages > 0 || c.GuildMaxBytes > 0
+}
+
+// overQuota reports whether messages and bytes are over the guild quotas
+// scaled by num/denom.
+func (c *StoreConfig) overQuota(messages int, bytes int64, num, denom int64) bool {
+	if c.GuildMaxMessages > 0 && int64(messages)*denom > int64(c.GuildMaxMessages)*num {
+		return true
+	}
+	return c.GuildMaxBytes > 0 && bytes*denom > c.GuildMaxBytes*num
+}
+
+func (c *StoreConfig) guildUsage(messages int, bytes int64) *GuildUsage {
+	return &GuildUsage{
+		Messages:    messages,
+		Bytes:       bytes,
+		MaxMessages: c.GuildMaxMessages,
+		MaxBytes:    c.GuildMaxBytes,
+	}
+}
+
+// usageCounter keeps the usage of the guilds that have been counted since the
+// store was opened, so the guild doesn't have to be scanned on every write.
+// Messages that expire aren't subtracted, so the counts are recounted on
+// every garbage collection.
+type usageCounter struct {
+	mu     sync.Mutex
+	guilds map[string]*usageCount
+}
+
+type usageCount struct {
+	messages int
+	bytes    int64
+}
+
+func (c *usageCounter) get(gid string) (usageCount, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u, ok := c.guilds[gid]
+	if !ok {
+		return usageCount{}, false
+	}
+	return *u, true
+}
+
+func (c *usageCounter) set(gid string, u usageCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.guilds == nil {
+		c.guilds = make(map[string]*usageCount)
+	}
+	c.guilds[gid] = &u
+}
+
+// add changes the usage of a guild if it has been counted. Guilds that
+// haven't been counted pick the change up when they are.
+func (c *usageCounter) add(gid string, messages int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if u, ok := c.guilds[gid]; ok {
+		u.messages += messages
+		u.bytes += bytes
+	}
+}
+
+func (c *usageCounter) forget(gids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, gid := range gids {
+		delete(c.guilds, gid)
+	}
+}
+
+func (c *usageCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.guilds = nil
+}
+
+// The size of every message is kept under a usage key sorted by message ID,
+// expiring together with the message. The size is the size of the stored
+// record plus the size of its attachments.
+func usagePrefix(gid string) string {
+	return fmt.Sprintf("usage:%s:", gid)
+}
+
+func usageKey(gid, mid string) string {
+	return usagePrefix(gid) + sortableID(mid)
+}
+
+// setUsage stores the size of a message and returns how much the usage of the
+// guild changed by. A message that is stored again only changes the bytes.
+func setUsage(txn *badger.Txn, gid, mid string, size int64, ttl time.Duration) (messages int, bytes int64, err error) {
+	key := []byte(usageKey(gid, mid))
+	prev, err := getUsage(txn, key)
+	switch {
+	case err == badger.ErrKeyNotFound:
+		messages = 1
+	case err != nil:
+		return 0, 0, err
+	}
+
+	entry := badger.NewEntry(key, []byte(strconv.FormatInt(size, 10))).WithTTL(ttl)
+	if err := txn.SetEntry(entry); err != nil {
+		return 0, 0, err
+	}
+	return messages, size - prev, nil
+}
+
+func getUsage(txn *badger.Txn, key []byte) (int64, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+func attachmentsSize(attachments []*Attachment) int64 {
+	var size int64
+	for _, a := range attachments {
+		size += int64(a.Size)
+	}
+	return size
+}
+
+type usageEntry struct {
+	id   string
+	size int64
+}
+
+// countUsage goes through the usage keys of a guild, oldest message first.
+func (s *Store) countUsage(ctx context.Context, gid string) ([]usageEntry, usageCount, error) {
+	var entries []usageEntry
+	var total usageCount
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(usagePrefix(gid))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			size, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid usage %s: %w", it.Item().Key(), err)
+			}
+			id := strings.TrimPrefix(string(it.Item().Key()), string(prefix))
+			entries = append(entries, usageEntry{id, size})
+			total.messages++
+			total.bytes += size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, usageCount{}, err
+	}
+	s.usage.set(gid, total)
+	return entries, total, nil
+}
+
+// GuildUsage returns how many messages a guild stores and how large they are.
+// Messages stored before usage was tracked aren't counted.
+func (s *Store) GuildUsage(ctx context.Context, gid string) (*GuildUsage, error) {
+	u, ok := s.usage.get(gid)
+	if !ok {
+		var err error
+		if _, u, err = s.countUsage(ctx, gid); err != nil {
+			return nil, err
+		}
+	}
+	return s.config.guildUsage(u.messages, u.bytes), nil
+}
+
+// enforceQuota evicts the oldest messages of a guild that is over its quota.
+func (s *Store) enforceQuota(ctx context.Context, gid string) error {
+	if !s.config.hasQuota() {
+		return nil
+	}
+	if u, ok := s.usage.get(gid); ok && !s.config.overQuota(u.messages, u.bytes, 1, 1) {
+		return nil
+	}
+
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	// recount to leave out expired messages, and in case another write
+	// already evicted
+	entries, total, err := s.countUsage(ctx, gid)
+	if err != nil {
+		return err
+	}
+	if !s.config.overQuota(total.messages, total.bytes, 1, 1) {
+		return nil
+	}
+
+	n := 0
+	remaining := total
+	for n < len(entries) && s.config.overQuota(remaining.messages, remaining.bytes, quotaLowWaterNum, quotaLowWaterDenom) {
+		remaining.messages--
+		remaining.bytes -= entries[n].size
+		n++
+	}
+
+	evicted, err := s.evict(ctx, gid, entries[:n])
+	s.usage.forget(gid)
+	if evicted > 0 {
+		s.logger.Info("evicted messages over guild quota",
+			zap.String("guild", gid),
+			zap.Int("messages", evicted),
+		)
+	}
+	return err
+}
+
+// evict deletes the messages of entries with their indexes, and the
+// attachments no other message refers to.
+func (s *Store) evict(ctx context.Context, gid string, entries []usageEntry) (int, error) {
+	evicted := 0
+	hashes := make(map[string]bool)
+	for len(entries) > 0 {
+		if err := ctx.Err(); err != nil {
+			return evicted, err
+		}
+		batch := entries[:min(evictBatchSize, len(entries))]
+		entries = entries[len(batch):]
+
+		deleted := 0
+		err := s.update(func(txn *badger.Txn) error {
+			deleted = 0
+			for _, e := range batch {
+				usageKey := []byte(usagePrefix(gid) + e.id)
+				item, err := txn.Get([]byte(guildIndexPrefix(gid) + e.id))
+				if err == badger.ErrKeyNotFound {
+					if err := txn.Delete(usageKey); err != nil {
+						return err
+					}
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				messageKey, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+
+				message, err := s.deleteMessage(txn, messageKey)
+				if err == badger.ErrKeyNotFound {
+					if err := txn.Delete(usageKey); err != nil {
+						return err
+					}
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				for _, a := range message.Attachments {
+					if a.Hash != "" {
+						hashes[a.Hash] = true
+					}
+				}
+				deleted++
+			}
+			return nil
+		})
+		if err != nil {
+			return evicted, err
+		}
+		evicted += deleted
+	}
+
+	return evicted, s.deleteUnreferencedBlobs(hashes, blobGracePeriod)
+}
+
+// FormatBytes formats n as a size in binary units, like 1.5 MiB.
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
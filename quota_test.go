@@ -0,0 +1,112 @@
+package stare
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverQuota(t *testing.T) {
+	config := &StoreConfig{GuildMaxMessages: 100, GuildMaxBytes: 1000}
+
+	tests := []struct {
+		name       string
+		messages   int
+		bytes      int64
+		num, denom int64
+		want       bool
+	}{
+		{"under", 50, 500, 1, 1, false},
+		{"at quota", 100, 1000, 1, 1, false},
+		{"over messages", 101, 500, 1, 1, true},
+		{"over bytes", 50, 1001, 1, 1, true},
+		{"at low water", 90, 900, quotaLowWaterNum, quotaLowWaterDenom, false},
+		{"over low water messages", 91, 900, quotaLowWaterNum, quotaLowWaterDenom, true},
+		{"over low water bytes", 90, 901, quotaLowWaterNum, quotaLowWaterDenom, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := config.overQuota(tt.messages, tt.bytes, tt.num, tt.denom); got != tt.want {
+				t.Errorf("overQuota(%v, %v, %v, %v) = %v, want %v", tt.messages, tt.bytes, tt.num, tt.denom, got, tt.want)
+			}
+		})
+	}
+
+	unlimited := &StoreConfig{}
+	if unlimited.overQuota(1<<30, 1<<40, 1, 1) {
+		t.Error("overQuota without quotas = true, want false")
+	}
+}
+
+func TestStorageEnforceQuota(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxMessages int
+		maxBytes    int64
+		stored      int
+		// wantMessages is how many of the newest messages are kept, or -1 if
+		// that depends on the size of the records
+		wantMessages int
+	}{
+		{"under the quota", 10, 0, 10, 10},
+		{"one over", 10, 0, 11, 9},
+		{"low water rounds down", 15, 0, 16, 13},
+		{"evicted again", 10, 0, 21, 9},
+		{"byte quota", 0, 10 * 1024, 20, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configure := func(config *StoreConfig) {
+				config.GuildMaxMessages = tt.maxMessages
+				config.GuildMaxBytes = tt.maxBytes
+			}
+			forEachStorage(t, configure, func(t *testing.T, s Storage) {
+				ctx := context.Background()
+				var ids []string
+				for i := 0; i < tt.stored; i++ {
+					id := strconv.Itoa(1000 + i)
+					ids = append(ids, id)
+					msg := testMessage("1", "2", "3", id, "content")
+					if tt.maxBytes > 0 {
+						msg.Attachments = []*Attachment{{Filename: "a.txt", Size: 1024, Data: []byte(strings.Repeat("x", 1024))}}
+					}
+					if err := s.SetMessage(ctx, msg, time.Hour); err != nil {
+						t.Fatalf("SetMessage: %v", err)
+					}
+				}
+
+				usage, err := s.GuildUsage(ctx, "1")
+				if err != nil {
+					t.Fatalf("GuildUsage: %v", err)
+				}
+				if usage.MaxMessages > 0 && usage.Messages > usage.MaxMessages {
+					t.Errorf("%v messages stored, over the quota of %v", usage.Messages, usage.MaxMessages)
+				}
+				if usage.MaxBytes > 0 && usage.Bytes > usage.MaxBytes {
+					t.Errorf("%v bytes stored, over the quota of %v", usage.Bytes, usage.MaxBytes)
+				}
+
+				kept, err := s.GetGuildMessages(ctx, "1", MessageQuery{})
+				if err != nil {
+					t.Fatalf("GetGuildMessages: %v", err)
+				}
+				if tt.wantMessages >= 0 && len(kept) != tt.wantMessages {
+					t.Errorf("%v messages kept, want %v", len(kept), tt.wantMessages)
+				}
+				if len(kept) != usage.Messages {
+					t.Errorf("%v messages kept, but usage counts %v", len(kept), usage.Messages)
+				}
+				if tt.wantMessages < 0 && (len(kept) == 0 || len(kept) == tt.stored) {
+					t.Errorf("%v of %v messages kept, want the oldest evicted", len(kept), tt.stored)
+				}
+				// the oldest are evicted first
+				if got, want := messageIDs(kept), ids[len(ids)-len(kept):]; !slices.Equal(got, want) {
+					t.Errorf("kept messages %v, want the newest %v", got, want)
+				}
+			})
+		})
+	}
+}
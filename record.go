@@ -0,0 +1,341 @@
+package stare
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Messages are stored as records in a format owned by this project rather
+// than as gob encoded discordgo structs, so discordgo upgrades can't make
+// stored messages unreadable. Only the fields that end up in logs are kept.
+//
+// A record starts with recordMagic followed by the record version as a
+// uvarint. Gob streams start with a message length, which is either a byte
+// below 0x80 or a byte count at 0xf8 and up, so the magic byte can never be
+// mistaken for a legacy gob encoded message.
+//
+// Version 2 added the content hash of stored attachments, whose data may be
+// kept in a BlobStore instead of in the record. Version 3 added the earlier
+// revisions of edited messages.
+const (
+	recordMagic   byte = 0xa1
+	recordVersion      = 3
+)
+
+var errInvalidRecord = errors.New("invalid record")
+
+// MarshalBinary encodes the message as a record.
+func (m *DiscordMessage) MarshalBinary() ([]byte, error) {
+	w := &recordWriter{}
+	w.buf.WriteByte(recordMagic)
+	w.uvarint(recordVersion)
+
+	msg := m.Message
+	w.string(msg.ID)
+	w.string(msg.ChannelID)
+	w.string(msg.GuildID)
+	w.string(msg.Content)
+	w.time(msg.Timestamp)
+	if msg.EditedTimestamp != nil {
+		w.time(*msg.EditedTimestamp)
+	} else {
+		w.time(time.Time{})
+	}
+
+	author := msg.Author
+	if author == nil {
+		author = &discordgo.User{}
+	}
+	w.string(author.ID)
+	w.string(author.Username)
+	w.string(author.Discriminator)
+	w.string(author.GlobalName)
+	w.string(author.Avatar)
+	w.bool(author.Bot)
+
+	w.embeds(msg.Embeds)
+	w.attachments(msg.Attachments)
+
+	w.uvarint(uint64(len(m.Attachments)))
+	for _, a := range m.Attachments {
+		w.string(a.Filename)
+		w.varint(int64(a.Size))
+		w.string(a.Hash)
+		w.bytes(a.Data)
+	}
+
+	w.uvarint(uint64(len(m.Revisions)))
+	for _, rev := range m.Revisions {
+		w.string(rev.Content)
+		w.time(rev.Timestamp)
+		w.embeds(rev.Embeds)
+		w.attachments(rev.Attachments)
+	}
+
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a message record, or a legacy gob encoded message.
+func (m *DiscordMessage) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != recordMagic {
+		return m.unmarshalGob(data)
+	}
+
+	r := &recordReader{data: data[1:]}
+	version := r.uvarint()
+	if r.err == nil && (version < 1 || version > recordVersion) {
+		return fmt.Errorf("unsupported record version %v", version)
+	}
+
+	msg := &discordgo.Message{}
+	msg.ID = r.string()
+	msg.ChannelID = r.string()
+	msg.GuildID = r.string()
+	msg.Content = r.string()
+	msg.Timestamp = r.time()
+	if edited := r.time(); !edited.IsZero() {
+		msg.EditedTimestamp = &edited
+	}
+
+	msg.Author = &discordgo.User{
+		ID:            r.string(),
+		Username:      r.string(),
+		Discriminator: r.string(),
+		GlobalName:    r.string(),
+		Avatar:        r.string(),
+		Bot:           r.bool(),
+	}
+
+	msg.Embeds = r.embeds()
+	msg.Attachments = r.attachments()
+
+	attachments := []*Attachment{}
+	for i, n := 0, r.count(); i < n; i++ {
+		a := &Attachment{
+			Filename: r.string(),
+			Size:     int(r.varint()),
+		}
+		if version >= 2 {
+			a.Hash = r.string()
+		}
+		a.Data = r.bytes()
+		attachments = append(attachments, a)
+	}
+
+	var revisions []*MessageRevision
+	if version >= 3 {
+		for i, n := 0, r.count(); i < n; i++ {
+			revisions = append(revisions, &MessageRevision{
+				Content:     r.string(),
+				Timestamp:   r.time(),
+				Embeds:      r.embeds(),
+				Attachments: r.attachments(),
+			})
+		}
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	m.Message = msg
+	m.Attachments = attachments
+	m.Revisions = revisions
+	return nil
+}
+
+// legacyMessage has the fields DiscordMessage had when messages were stored
+// gob encoded. Gob would decode into DiscordMessage with UnmarshalBinary,
+// which only reads records.
+type legacyMessage struct {
+	Message     *discordgo.Message
+	Attachments []*Attachment
+}
+
+func (m *DiscordMessage) unmarshalGob(data []byte) error {
+	var legacy legacyMessage
+	if err := decodeGob(data, &legacy); err != nil {
+		return err
+	}
+	m.Message = legacy.Message
+	m.Attachments = legacy.Attachments
+	if m.Attachments == nil {
+		m.Attachments = []*Attachment{}
+	}
+	m.Revisions = nil
+	return nil
+}
+
+type recordWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *recordWriter) uvarint(v uint64) {
+	w.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (w *recordWriter) varint(v int64) {
+	w.buf.Write(binary.AppendVarint(nil, v))
+}
+
+func (w *recordWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *recordWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *recordWriter) bool(b bool) {
+	if b {
+		w.buf.WriteByte(1)
+	} else {
+		w.buf.WriteByte(0)
+	}
+}
+
+// time writes t as unix nanoseconds, with the zero time written as 0.
+func (w *recordWriter) time(t time.Time) {
+	if t.IsZero() {
+		w.varint(0)
+		return
+	}
+	w.varint(t.UnixNano())
+}
+
+// embeds writes a summary of embeds, leaving out everything but the type,
+// title, description and URL.
+func (w *recordWriter) embeds(embeds []*discordgo.MessageEmbed) {
+	w.uvarint(uint64(len(embeds)))
+	for _, e := range embeds {
+		w.string(string(e.Type))
+		w.string(e.Title)
+		w.string(e.Description)
+		w.string(e.URL)
+	}
+}
+
+// attachments writes the metadata of message attachments.
+func (w *recordWriter) attachments(attachments []*discordgo.MessageAttachment) {
+	w.uvarint(uint64(len(attachments)))
+	for _, a := range attachments {
+		w.string(a.ID)
+		w.string(a.Filename)
+		w.string(a.URL)
+		w.string(a.ContentType)
+		w.varint(int64(a.Size))
+	}
+}
+
+// recordReader reads the values written by recordWriter. The first error is
+// kept and every read after it returns a zero value.
+type recordReader struct {
+	data []byte
+	err  error
+}
+
+func (r *recordReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errInvalidRecord
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *recordReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errInvalidRecord
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads a slice length, making sure it can't be larger than the data
+// that is left.
+func (r *recordReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.err = errInvalidRecord
+		return 0
+	}
+	return int(n)
+}
+
+func (r *recordReader) bytes() []byte {
+	n := r.count()
+	if r.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.data[:n])
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *recordReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *recordReader) bool() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.data) == 0 {
+		r.err = errInvalidRecord
+		return false
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b == 1
+}
+
+func (r *recordReader) time() time.Time {
+	v := r.varint()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v).UTC()
+}
+
+func (r *recordReader) embeds() []*discordgo.MessageEmbed {
+	var embeds []*discordgo.MessageEmbed
+	for i, n := 0, r.count(); i < n; i++ {
+		embeds = append(embeds, &discordgo.MessageEmbed{
+			Type:        discordgo.EmbedType(r.string()),
+			Title:       r.string(),
+			Description: r.string(),
+			URL:         r.string(),
+		})
+	}
+	return embeds
+}
+
+func (r *recordReader) attachments() []*discordgo.MessageAttachment {
+	var attachments []*discordgo.MessageAttachment
+	for i, n := 0, r.count(); i < n; i++ {
+		attachments = append(attachments, &discordgo.MessageAttachment{
+			ID:          r.string(),
+			Filename:    r.string(),
+			URL:         r.string(),
+			ContentType: r.string(),
+			Size:        int(r.varint()),
+		})
+	}
+	return attachments
+}
@@ -0,0 +1,167 @@
+package stare
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	sent := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	edited := sent.Add(time.Minute)
+
+	tests := []struct {
+		name string
+		msg  *DiscordMessage
+	}{
+		{
+			name: "minimal",
+			msg: &DiscordMessage{
+				Message:     &discordgo.Message{ID: "1", ChannelID: "2", GuildID: "3", Author: &discordgo.User{}},
+				Attachments: []*Attachment{},
+			},
+		},
+		{
+			name: "full",
+			msg: &DiscordMessage{
+				Message: &discordgo.Message{
+					ID:              "100",
+					ChannelID:       "200",
+					GuildID:         "300",
+					Content:         "edited content",
+					Timestamp:       sent,
+					EditedTimestamp: &edited,
+					Author: &discordgo.User{
+						ID:            "400",
+						Username:      "user",
+						Discriminator: "0",
+						GlobalName:    "User",
+						Avatar:        "abc",
+						Bot:           true,
+					},
+					Embeds: []*discordgo.MessageEmbed{
+						{Type: discordgo.EmbedTypeRich, Title: "title", Description: "description", URL: "https://example.com"},
+					},
+					Attachments: []*discordgo.MessageAttachment{
+						{ID: "500", Filename: "a.png", URL: "https://cdn.example.com/a.png", ContentType: "image/png", Size: 3},
+					},
+				},
+				Attachments: []*Attachment{
+					{Filename: "a.png", Size: 3, Hash: "hash", Data: []byte{}},
+					{Filename: "b.txt", Size: 2, Data: []byte("hi")},
+				},
+				Revisions: []*MessageRevision{
+					{Content: "original content", Timestamp: sent},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.msg.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if data[0] != recordMagic {
+				t.Fatalf("record starts with %#x, want %#x", data[0], recordMagic)
+			}
+
+			var got DiscordMessage
+			if err := got.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if !reflect.DeepEqual(&got, tt.msg) {
+				t.Errorf("UnmarshalBinary = %+v, want %+v", &got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestRecordInvalid(t *testing.T) {
+	msg := &DiscordMessage{
+		Message: &discordgo.Message{ID: "1", ChannelID: "2", GuildID: "3", Content: "content"},
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"truncated", data[:len(data)-3], errInvalidRecord},
+		{"magic only", []byte{recordMagic}, errInvalidRecord},
+		{"unsupported version", []byte{recordMagic, recordVersion + 1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got DiscordMessage
+			err := got.UnmarshalBinary(tt.data)
+			if err == nil {
+				t.Fatal("UnmarshalBinary succeeded, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("UnmarshalBinary error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testdata/legacy_message.gob is a message gob encoded the way messages were
+// stored before the record format.
+func TestRecordLegacyGob(t *testing.T) {
+	data, err := os.ReadFile("testdata/legacy_message.gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got DiscordMessage
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+
+	msg := got.Message
+	if msg.ID != "1102573094470000000" || msg.ChannelID != "222" || msg.GuildID != "111" {
+		t.Errorf("IDs = %v, %v, %v", msg.ID, msg.ChannelID, msg.GuildID)
+	}
+	if msg.Content != "legacy content" {
+		t.Errorf("Content = %q, want %q", msg.Content, "legacy content")
+	}
+	if want := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC); !msg.Timestamp.Equal(want) {
+		t.Errorf("Timestamp = %v, want %v", msg.Timestamp, want)
+	}
+	if msg.Author == nil || msg.Author.Username != "olduser" {
+		t.Errorf("Author = %+v, want olduser", msg.Author)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Filename != "cat.png" {
+		t.Errorf("message attachments = %+v", msg.Attachments)
+	}
+
+	want := []*Attachment{{Filename: "cat.png", Size: 3, Data: []byte{1, 2, 3}}}
+	if !reflect.DeepEqual(got.Attachments, want) {
+		t.Errorf("Attachments = %+v, want %+v", got.Attachments, want)
+	}
+	if len(got.Revisions) != 0 {
+		t.Errorf("Revisions = %+v, want none", got.Revisions)
+	}
+
+	// stored again, it becomes a record
+	data, err = got.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var again DiscordMessage
+	if err := again.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary of the re-encoded message: %v", err)
+	}
+	if again.Message.Content != msg.Content || !reflect.DeepEqual(again.Attachments, want) {
+		t.Errorf("re-encoded message = %+v", again)
+	}
+}
@@ -0,0 +1,59 @@
+package stare
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func formatColor(color int) string {
+	if color == 0 {
+		return "Default"
+	}
+	return fmt.Sprintf("#%06x", color)
+}
+
+func formatRole(r *discordgo.Role) string {
+	return fmt.Sprintf("<@&%v>\n%v", r.ID, r.Name)
+}
+
+// roleUpdateFields returns an embed field for every logged setting that
+// differs between old and cur. Changes to other settings, like the position
+// of the role, are left out.
+func roleUpdateFields(old, cur *discordgo.Role) []*discordgo.MessageEmbedField {
+	var fields []*discordgo.MessageEmbedField
+	change := func(name, before, after string) {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  name,
+			Value: fmt.Sprintf("%v → %v", before, after),
+		})
+	}
+
+	if old.Name != cur.Name {
+		change("Name", old.Name, cur.Name)
+	}
+	if old.Color != cur.Color {
+		change("Colour", formatColor(old.Color), formatColor(cur.Color))
+	}
+	if old.Hoist != cur.Hoist {
+		change("Displayed separately", formatBool(old.Hoist), formatBool(cur.Hoist))
+	}
+	if old.Mentionable != cur.Mentionable {
+		change("Mentionable", formatBool(old.Mentionable), formatBool(cur.Mentionable))
+	}
+
+	added, removed := diffPermissions(old.Permissions, cur.Permissions)
+	if added != 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  "Permissions granted",
+			Value: formatPermissions(added),
+		})
+	}
+	if removed != 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  "Permissions revoked",
+			Value: formatPermissions(removed),
+		})
+	}
+	return fields
+}
@@ -0,0 +1,118 @@
+package stare
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// guildSetting is a guild setting that can be changed with /settings. Values
+// are handled as strings, so changes can be recorded as revisions.
+type guildSetting struct {
+	// Name is the value used for the setting in commands and revisions
+	Name string
+	// Choice is the name shown in the /settings set choices
+	Choice string
+	// Title is the name shown in the settings embed
+	Title  string
+	get    func(g *Guild) string
+	set    func(g *Guild, value string)
+	format func(value string) string
+}
+
+func logChannelSetting(name, choice, title string, channel func(g *Guild) *string) *guildSetting {
+	return &guildSetting{
+		Name:   name,
+		Choice: choice,
+		Title:  title,
+		get:    func(g *Guild) string { return *channel(g) },
+		set:    func(g *Guild, value string) { *channel(g) = value },
+		format: formatChannel,
+	}
+}
+
+// logSettings are the log channels that can be set with /settings set.
+var logSettings = []*guildSetting{
+	logChannelSetting("join", "User Join", "Join log", func(g *Guild) *string { return &g.JoinLog }),
+	logChannelSetting("leave", "User Leave", "Leave log", func(g *Guild) *string { return &g.LeaveLog }),
+	logChannelSetting("msgdelete", "Message Delete", "Message delete log", func(g *Guild) *string { return &g.MsgDeleteLog }),
+	logChannelSetting("msgedit", "Message Edit", "Message edit log", func(g *Guild) *string { return &g.MsgEditLog }),
+	logChannelSetting("ban", "User Ban", "Ban log", func(g *Guild) *string { return &g.BanLog }),
+	logChannelSetting("unban", "User Unban", "Unban log", func(g *Guild) *string { return &g.UnbanLog }),
+	logChannelSetting("memberupdate", "Member Update", "Member update log", func(g *Guild) *string { return &g.MemberUpdateLog }),
+	logChannelSetting("channel", "Channel Changes", "Channel log", func(g *Guild) *string { return &g.ChannelLog }),
+	logChannelSetting("role", "Role Changes", "Role log", func(g *Guild) *string { return &g.RoleLog }),
+	logChannelSetting("voice", "Voice Activity", "Voice log", func(g *Guild) *string { return &g.VoiceLog }),
+}
+
+var retentionSetting = &guildSetting{
+	Name:  "retention",
+	Title: "Message retention",
+	get:   func(g *Guild) string { return strconv.Itoa(g.MessageRetention) },
+	set: func(g *Guild, value string) {
+		g.MessageRetention, _ = strconv.Atoi(value)
+	},
+	format: func(value string) string {
+		hours, _ := strconv.Atoi(value)
+		if hours <= 0 {
+			return "Default"
+		}
+		return formatHours(hours)
+	},
+}
+
+// guildSettings are all the settings shown by /settings view.
+var guildSettings = append(append([]*guildSetting{}, logSettings...), retentionSetting)
+
+func findSetting(name string) (*guildSetting, bool) {
+	return findSettingIn(guildSettings, name)
+}
+
+func findLogSetting(name string) (*guildSetting, bool) {
+	return findSettingIn(logSettings, name)
+}
+
+func findSettingIn(settings []*guildSetting, name string) (*guildSetting, bool) {
+	for _, s := range settings {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Get returns the current value of the setting in g.
+func (s *guildSetting) Get(g *Guild) string {
+	return s.get(g)
+}
+
+// Set changes the setting in g and returns the value it had before.
+func (s *guildSetting) Set(g *Guild, value string) string {
+	old := s.get(g)
+	s.set(g, value)
+	return old
+}
+
+// Format renders a value of the setting for use in embeds.
+func (s *guildSetting) Format(value string) string {
+	return s.format(value)
+}
+
+func formatChannel(id string) string {
+	if id == "" {
+		return "None"
+	}
+	return fmt.Sprintf("<#%v>", id)
+}
+
+func formatHours(hours int) string {
+	switch {
+	case hours%24 == 0 && hours > 24:
+		return fmt.Sprintf("%v days", hours/24)
+	case hours == 24:
+		return "1 day"
+	case hours == 1:
+		return "1 hour"
+	default:
+		return fmt.Sprintf("%v hours", hours)
+	}
+}
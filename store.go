@@ -0,0 +1,210 @@
+package stare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ErrNotFound is returned by stores when a member or message is not stored,
+// or has expired.
+var ErrNotFound = errors.New("not found")
+
+type MemberStore interface {
+	SetMember(ctx context.Context, m *discordgo.Member) error
+	GetMember(ctx context.Context, gid, uid string) (*discordgo.Member, error)
+	DeleteMember(ctx context.Context, gid, uid string) error
+	// AddMemberSnapshot records the names, roles and guild avatar of a member
+	// if any of them changed since the last snapshot, and stops the history
+	// of the member from expiring.
+	AddMemberSnapshot(ctx context.Context, m *discordgo.Member) error
+	// GetMemberHistory returns the snapshots of a member, oldest first.
+	GetMemberHistory(ctx context.Context, gid, uid string) ([]*MemberSnapshot, error)
+	// ExpireMemberHistory makes the history of a member who left the guild
+	// expire after the configured member history TTL.
+	ExpireMemberHistory(ctx context.Context, gid, uid string) error
+	// GetMemberHistoryIDs returns the IDs of the members of a guild whose
+	// history isn't expiring, so the ones who left while the bot was offline
+	// can be found.
+	GetMemberHistoryIDs(ctx context.Context, gid string) ([]string, error)
+}
+
+// ChannelStore keeps the last known version of guild channels, so updates can
+// be compared against it.
+type ChannelStore interface {
+	SetChannel(ctx context.Context, c *discordgo.Channel) error
+	GetChannel(ctx context.Context, gid, cid string) (*discordgo.Channel, error)
+	DeleteChannel(ctx context.Context, gid, cid string) error
+}
+
+// RoleStore keeps the last known version of guild roles, so updates can be
+// compared against it and deleted roles can still be named.
+type RoleStore interface {
+	SetRole(ctx context.Context, gid string, r *discordgo.Role) error
+	GetRole(ctx context.Context, gid, rid string) (*discordgo.Role, error)
+	DeleteRole(ctx context.Context, gid, rid string) error
+}
+
+// VoiceStore keeps the voice sessions of the members who are in a voice
+// channel.
+type VoiceStore interface {
+	SetVoiceSession(ctx context.Context, gid, uid string, v *VoiceSession) error
+	GetVoiceSession(ctx context.Context, gid, uid string) (*VoiceSession, error)
+	// GetVoiceSessions returns the voice sessions in a guild by user ID.
+	GetVoiceSessions(ctx context.Context, gid string) (map[string]*VoiceSession, error)
+	DeleteVoiceSession(ctx context.Context, gid, uid string) error
+}
+
+type MessageStore interface {
+	SetMessage(ctx context.Context, msg *DiscordMessage, ttl time.Duration) error
+	GetMessage(ctx context.Context, gid, cid, mid string) (*DiscordMessage, error)
+	// GetMessageLog returns the messages of a user in a guild selected by q,
+	// oldest first. The data of their attachments is not loaded.
+	GetMessageLog(ctx context.Context, gid, uid string, q MessageQuery) ([]*DiscordMessage, error)
+	// WalkMessageLog calls fn for the same messages as GetMessageLog, one at a
+	// time, so they don't all have to be kept in memory. Walking stops at the
+	// first error returned by fn. fn must not use the store.
+	WalkMessageLog(ctx context.Context, gid, uid string, q MessageQuery, fn func(*DiscordMessage) error) error
+	// GetChannelMessages returns the messages in a channel selected by q,
+	// oldest first. The data of their attachments is not loaded.
+	GetChannelMessages(ctx context.Context, gid, cid string, q MessageQuery) ([]*DiscordMessage, error)
+	// GetGuildMessages returns the messages in any channel of a guild
+	// selected by q, oldest first. The data of their attachments is not
+	// loaded.
+	GetGuildMessages(ctx context.Context, gid string, q MessageQuery) ([]*DiscordMessage, error)
+	// AddAttachments adds downloaded attachments to a stored message without
+	// changing when it expires.
+	AddAttachments(ctx context.Context, gid, cid, mid string, attachments []*Attachment) error
+	// UpdateMessage changes a stored message with fn without changing when it
+	// expires. The message is read and written in one go, so attachments
+	// added in between aren't lost. Nothing is changed if fn returns an
+	// error, which is returned as is. The data of attachments is not loaded.
+	UpdateMessage(ctx context.Context, gid, cid, mid string, fn func(*DiscordMessage) error) error
+	// GuildUsage returns how many messages a guild stores, how large they are
+	// with their attachments, and the quotas the guild is held to.
+	GuildUsage(ctx context.Context, gid string) (*GuildUsage, error)
+}
+
+// MessageQuery selects messages by when they were sent. Results are paged by
+// passing the ID of the last message of a page as the cursor for the next.
+type MessageQuery struct {
+	// After and Before limit the messages to those sent in between, the zero
+	// time leaves that end of the range open
+	After  time.Time
+	Before time.Time
+	// Cursor is the ID of a message, only messages sent after it are selected
+	Cursor string
+	// Limit is the most messages selected, 0 selects all of them
+	Limit int
+}
+
+// collectMessages collects the messages walk calls its function with.
+func collectMessages(walk func(fn func(*DiscordMessage) error) error) ([]*DiscordMessage, error) {
+	var messages []*DiscordMessage
+	err := walk(func(msg *DiscordMessage) error {
+		messages = append(messages, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// discordEpoch is the first millisecond of 2015, the start of the timestamps
+// in snowflake IDs.
+const discordEpoch = 1420070400000
+
+// idRange returns the range of message IDs selected by q as sortable IDs.
+// from is inclusive and to is exclusive, an empty string leaves the range
+// open at that end.
+func (q MessageQuery) idRange() (from, to string, err error) {
+	if !q.After.IsZero() {
+		from = sortableID(snowflakeAt(q.After))
+	}
+	if q.Cursor != "" {
+		id, err := strconv.ParseUint(q.Cursor, 10, 64)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid cursor: %w", err)
+		}
+		if next := sortableID(strconv.FormatUint(id+1, 10)); next > from {
+			from = next
+		}
+	}
+	if !q.Before.IsZero() {
+		to = sortableID(snowflakeAt(q.Before))
+	}
+	return from, to, nil
+}
+
+// snowflakeAt returns the smallest snowflake ID with a timestamp of t or
+// later.
+func snowflakeAt(t time.Time) string {
+	ms := t.UnixMilli() - discordEpoch
+	if ms < 0 {
+		ms = 0
+	}
+	return strconv.FormatUint(uint64(ms)<<22, 10)
+}
+
+// sortableID pads a snowflake ID with zeros, so sorting IDs as strings sorts
+// them by when they were created.
+func sortableID(id string) string {
+	const width = 20
+	if len(id) >= width {
+		return id
+	}
+	return strings.Repeat("0", width-len(id)) + id
+}
+
+// Storage is where the bot keeps the members and messages it has seen.
+type Storage interface {
+	MemberStore
+	ChannelStore
+	RoleStore
+	VoiceStore
+	MessageStore
+	// PurgeUser deletes the messages, attachments, member, member history and
+	// voice session of a user in a guild, or in every guild if gid is empty.
+	PurgeUser(ctx context.Context, gid, uid string) (*PurgeResult, error)
+	Close() error
+}
+
+// PurgeResult describes what PurgeUser deleted.
+type PurgeResult struct {
+	Messages int
+	// Attachments counts the attachments of the deleted messages. The data of
+	// an attachment that a kept message has too is not deleted, but the
+	// attachment is still counted.
+	Attachments int
+	// MemberRecords counts stored members, member histories and voice
+	// sessions
+	MemberRecords int
+	// Guilds are the guilds anything was deleted in
+	Guilds []string
+}
+
+func (r *PurgeResult) addGuild(gid string) {
+	if !slices.Contains(r.Guilds, gid) {
+		r.Guilds = append(r.Guilds, gid)
+	}
+}
+
+// NewStorage creates the storage named by kind, either "badger" for a Store
+// on disk or "memory" for a MemoryStore.
+func NewStorage(kind string, logger *ZapLogger, config *StoreConfig) (Storage, error) {
+	switch kind {
+	case "badger", "":
+		return NewStore(logger, config)
+	case "memory":
+		return NewMemoryStore(config), nil
+	default:
+		return nil, errors.New("unknown store type: " + kind)
+	}
+}
@@ -0,0 +1,418 @@
+package stare
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// testStorages are the Storage implementations every storage test is run
+// against, so they are checked to behave the same.
+var testStorages = []struct {
+	name string
+	open func(t *testing.T, config *StoreConfig) Storage
+}{
+	{"badger", func(t *testing.T, config *StoreConfig) Storage {
+		s, err := NewStore(NewLogger("test"), config)
+		if err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		return s
+	}},
+	{"memory", func(t *testing.T, config *StoreConfig) Storage {
+		return NewMemoryStore(config)
+	}},
+}
+
+func testStoreConfig(t *testing.T) *StoreConfig {
+	config := DefaultStoreConfig()
+	config.Dir = t.TempDir()
+	config.AttachmentDir = t.TempDir()
+	return config
+}
+
+// forEachStorage runs test against every Storage implementation, each with
+// its own empty store.
+func forEachStorage(t *testing.T, configure func(*StoreConfig), test func(t *testing.T, s Storage)) {
+	for _, ts := range testStorages {
+		t.Run(ts.name, func(t *testing.T) {
+			config := testStoreConfig(t)
+			if configure != nil {
+				configure(config)
+			}
+			s := ts.open(t, config)
+			t.Cleanup(func() { s.Close() })
+			test(t, s)
+		})
+	}
+}
+
+func testMessage(gid, cid, uid, mid, content string) *DiscordMessage {
+	return NewDiscordMessage(&discordgo.Message{
+		ID:        mid,
+		GuildID:   gid,
+		ChannelID: cid,
+		Content:   content,
+		Author:    &discordgo.User{ID: uid},
+	})
+}
+
+func TestStorageMembers(t *testing.T) {
+	forEachStorage(t, nil, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		mem := &discordgo.Member{
+			GuildID: "1",
+			User:    &discordgo.User{ID: "2", Username: "user"},
+			Nick:    "nick",
+			Roles:   []string{"3", "4"},
+		}
+		if err := s.SetMember(ctx, mem); err != nil {
+			t.Fatalf("SetMember: %v", err)
+		}
+
+		got, err := s.GetMember(ctx, "1", "2")
+		if err != nil {
+			t.Fatalf("GetMember: %v", err)
+		}
+		if got.Nick != "nick" || got.User.Username != "user" || len(got.Roles) != 2 {
+			t.Errorf("GetMember = %+v, want %+v", got, mem)
+		}
+
+		if err := s.DeleteMember(ctx, "1", "2"); err != nil {
+			t.Fatalf("DeleteMember: %v", err)
+		}
+		if _, err := s.GetMember(ctx, "1", "2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetMember after delete: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStorageMemberHistoryIDs(t *testing.T) {
+	forEachStorage(t, nil, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		for _, uid := range []string{"2", "3", "4"} {
+			mem := &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: uid}}
+			if err := s.AddMemberSnapshot(ctx, mem); err != nil {
+				t.Fatalf("AddMemberSnapshot: %v", err)
+			}
+		}
+		other := &discordgo.Member{GuildID: "9", User: &discordgo.User{ID: "5"}}
+		if err := s.AddMemberSnapshot(ctx, other); err != nil {
+			t.Fatalf("AddMemberSnapshot: %v", err)
+		}
+		if err := s.ExpireMemberHistory(ctx, "1", "3"); err != nil {
+			t.Fatalf("ExpireMemberHistory: %v", err)
+		}
+
+		ids, err := s.GetMemberHistoryIDs(ctx, "1")
+		if err != nil {
+			t.Fatalf("GetMemberHistoryIDs: %v", err)
+		}
+		if want := []string{"2", "4"}; !slices.Equal(ids, want) {
+			t.Errorf("GetMemberHistoryIDs = %v, want %v", ids, want)
+		}
+	})
+}
+
+func TestStorageMessages(t *testing.T) {
+	forEachStorage(t, nil, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		if err := s.SetMessage(ctx, testMessage("1", "2", "3", "100", "hello"), time.Hour); err != nil {
+			t.Fatalf("SetMessage: %v", err)
+		}
+
+		attachment := &Attachment{Filename: "a.txt", Size: 4, Data: []byte("data")}
+		if err := s.AddAttachments(ctx, "1", "2", "100", []*Attachment{attachment}); err != nil {
+			t.Fatalf("AddAttachments: %v", err)
+		}
+
+		got, err := s.GetMessage(ctx, "1", "2", "100")
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		if got.Message.Content != "hello" {
+			t.Errorf("content = %q, want %q", got.Message.Content, "hello")
+		}
+		if len(got.Attachments) != 1 || got.Attachments[0].Filename != "a.txt" || !bytes.Equal(got.Attachments[0].Data, []byte("data")) {
+			t.Errorf("attachments = %+v, want %+v", got.Attachments, []*Attachment{attachment})
+		}
+
+		tests := []struct {
+			name      string
+			gid, mid  string
+			wantFound bool
+		}{
+			{"stored", "1", "100", true},
+			{"other message", "1", "101", false},
+			{"other guild", "9", "100", false},
+		}
+		for _, tt := range tests {
+			_, err := s.GetMessage(ctx, tt.gid, "2", tt.mid)
+			if found := err == nil; found != tt.wantFound {
+				t.Errorf("%v: GetMessage error = %v, want found %v", tt.name, err, tt.wantFound)
+			}
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				t.Errorf("%v: GetMessage error = %v, want ErrNotFound", tt.name, err)
+			}
+		}
+
+		if err := s.AddAttachments(ctx, "1", "2", "101", []*Attachment{attachment}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddAttachments to a missing message: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStorageUpdateMessage(t *testing.T) {
+	forEachStorage(t, nil, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		if err := s.SetMessage(ctx, testMessage("1", "2", "3", "100", "original"), time.Hour); err != nil {
+			t.Fatalf("SetMessage: %v", err)
+		}
+		// downloaded after the edit was read, but before it was stored
+		attachment := &Attachment{Filename: "a.txt", Size: 4, Data: []byte("data")}
+		if err := s.AddAttachments(ctx, "1", "2", "100", []*Attachment{attachment}); err != nil {
+			t.Fatalf("AddAttachments: %v", err)
+		}
+
+		errSkip := errors.New("skip")
+		tests := []struct {
+			name         string
+			mid          string
+			fn           func(*DiscordMessage) error
+			wantErr      error
+			wantContent  string
+			wantRevision int
+		}{
+			{
+				name: "edited",
+				mid:  "100",
+				fn: func(msg *DiscordMessage) error {
+					msg.AddRevision(&discordgo.Message{Content: "edited"})
+					return nil
+				},
+				wantContent:  "edited",
+				wantRevision: 1,
+			},
+			{
+				name: "fn error leaves the message",
+				mid:  "100",
+				fn: func(msg *DiscordMessage) error {
+					msg.AddRevision(&discordgo.Message{Content: "discarded"})
+					return errSkip
+				},
+				wantErr:      errSkip,
+				wantContent:  "edited",
+				wantRevision: 1,
+			},
+			{
+				name:    "missing message",
+				mid:     "101",
+				fn:      func(*DiscordMessage) error { return nil },
+				wantErr: ErrNotFound,
+			},
+		}
+		for _, tt := range tests {
+			err := s.UpdateMessage(ctx, "1", "2", tt.mid, tt.fn)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("%v: UpdateMessage error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			if tt.wantContent == "" {
+				continue
+			}
+
+			got, err := s.GetMessage(ctx, "1", "2", tt.mid)
+			if err != nil {
+				t.Fatalf("%v: GetMessage: %v", tt.name, err)
+			}
+			if got.Message.Content != tt.wantContent || got.Revision() != tt.wantRevision {
+				t.Errorf("%v: message is %q at revision %v, want %q at revision %v",
+					tt.name, got.Message.Content, got.Revision(), tt.wantContent, tt.wantRevision)
+			}
+			if len(got.Attachments) != 1 || !bytes.Equal(got.Attachments[0].Data, attachment.Data) {
+				t.Errorf("%v: attachments = %+v, want the added attachment kept", tt.name, got.Attachments)
+			}
+		}
+	})
+}
+
+func TestMessageQueryIDRange(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	id := snowflakeAt(at)
+
+	tests := []struct {
+		name     string
+		q        MessageQuery
+		wantFrom string
+		wantTo   string
+		wantErr  bool
+	}{
+		{"open", MessageQuery{}, "", "", false},
+		{"after", MessageQuery{After: at}, sortableID(id), "", false},
+		{"before", MessageQuery{Before: at}, "", sortableID(id), false},
+		{"before the epoch", MessageQuery{After: time.Unix(0, 0)}, sortableID("0"), "", false},
+		{"cursor", MessageQuery{Cursor: "41"}, sortableID("42"), "", false},
+		{"cursor after the range start", MessageQuery{After: time.Unix(0, 0), Cursor: "41"}, sortableID("42"), "", false},
+		{"cursor before the range start", MessageQuery{After: at, Cursor: "41"}, sortableID(id), "", false},
+		{"invalid cursor", MessageQuery{Cursor: "abc"}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := tt.q.idRange()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("idRange error = %v, want error %v", err, tt.wantErr)
+			}
+			if from != tt.wantFrom || to != tt.wantTo {
+				t.Errorf("idRange = %q, %q, want %q, %q", from, to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestStorageMessageQuery(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// five messages a minute apart, the last one in another channel
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, snowflakeAt(start.Add(time.Duration(i)*time.Minute)))
+	}
+
+	forEachStorage(t, nil, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		for i, id := range ids {
+			cid := "2"
+			if i == len(ids)-1 {
+				cid = "3"
+			}
+			if err := s.SetMessage(ctx, testMessage("1", cid, "4", id, strconv.Itoa(i)), time.Hour); err != nil {
+				t.Fatalf("SetMessage: %v", err)
+			}
+		}
+
+		tests := []struct {
+			name string
+			q    MessageQuery
+			want []string
+		}{
+			{"all", MessageQuery{}, ids[:4]},
+			{"limit", MessageQuery{Limit: 2}, ids[:2]},
+			{"after is inclusive", MessageQuery{After: start.Add(time.Minute)}, ids[1:4]},
+			{"before is exclusive", MessageQuery{Before: start.Add(2 * time.Minute)}, ids[:2]},
+			{"range", MessageQuery{After: start.Add(30 * time.Second), Before: start.Add(150 * time.Second)}, ids[1:3]},
+			{"cursor", MessageQuery{Cursor: ids[1]}, ids[2:4]},
+			{"cursor and limit", MessageQuery{Cursor: ids[0], Limit: 2}, ids[1:3]},
+			{"cursor at the end", MessageQuery{Cursor: ids[3]}, nil},
+		}
+		for _, tt := range tests {
+			got, err := s.GetChannelMessages(ctx, "1", "2", tt.q)
+			if err != nil {
+				t.Fatalf("%v: GetChannelMessages: %v", tt.name, err)
+			}
+			if gotIDs := messageIDs(got); !slices.Equal(gotIDs, tt.want) {
+				t.Errorf("%v: GetChannelMessages = %v, want %v", tt.name, gotIDs, tt.want)
+			}
+		}
+
+		// paging through the log of the user with the last ID of every page
+		var paged []string
+		q := MessageQuery{Limit: 2}
+		for pages := 0; pages < len(ids); pages++ {
+			page, err := s.GetMessageLog(ctx, "1", "4", q)
+			if err != nil {
+				t.Fatalf("GetMessageLog: %v", err)
+			}
+			if len(page) == 0 {
+				break
+			}
+			paged = append(paged, messageIDs(page)...)
+			q.Cursor = page[len(page)-1].Message.ID
+		}
+		if !slices.Equal(paged, ids) {
+			t.Errorf("paged message log = %v, want %v", paged, ids)
+		}
+	})
+}
+
+func messageIDs(messages []*DiscordMessage) []string {
+	var ids []string
+	for _, msg := range messages {
+		ids = append(ids, msg.Message.ID)
+	}
+	return ids
+}
+
+func TestStoragePurgeUser(t *testing.T) {
+	forEachStorage(t, nil, func(t *testing.T, s Storage) {
+		ctx := context.Background()
+		attachment := func(data string) *Attachment {
+			return &Attachment{Filename: data + ".txt", Size: len(data), Data: []byte(data)}
+		}
+		messages := []*DiscordMessage{
+			testMessage("1", "2", "3", "100", "a"),
+			testMessage("1", "2", "3", "101", "b"),
+			testMessage("1", "2", "4", "102", "c"),
+		}
+		// the second message shares an attachment with the first, and the
+		// message of the other user with the second
+		messages[0].Attachments = []*Attachment{attachment("one"), attachment("two")}
+		messages[1].Attachments = []*Attachment{attachment("two")}
+		messages[2].Attachments = []*Attachment{attachment("two")}
+		for _, msg := range messages {
+			if err := s.SetMessage(ctx, msg, time.Hour); err != nil {
+				t.Fatalf("SetMessage: %v", err)
+			}
+		}
+
+		result, err := s.PurgeUser(ctx, "", "3")
+		if err != nil {
+			t.Fatalf("PurgeUser: %v", err)
+		}
+		if result.Messages != 2 || result.Attachments != 3 || len(result.Guilds) != 1 || result.Guilds[0] != "1" {
+			t.Errorf("PurgeUser = %+v, want 2 messages with 3 attachments in guild 1", result)
+		}
+		if _, err := s.GetMessage(ctx, "1", "2", "100"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("purged message: got %v, want ErrNotFound", err)
+		}
+		kept, err := s.GetMessage(ctx, "1", "2", "102")
+		if err != nil {
+			t.Fatalf("message of another user: %v", err)
+		}
+		if len(kept.Attachments) != 1 || string(kept.Attachments[0].Data) != "two" {
+			t.Errorf("attachments of another user = %+v, want the shared attachment kept", kept.Attachments)
+		}
+
+		// a download that finishes after the purge doesn't store anything
+		if err := s.AddAttachments(ctx, "1", "2", "100", []*Attachment{attachment("late")}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddAttachments to a purged message: got %v, want ErrNotFound", err)
+		}
+		if store, ok := s.(*Store); ok {
+			blobs := 0
+			store.blobs.Walk(func(string, time.Time) error {
+				blobs++
+				return nil
+			})
+			if blobs != 1 {
+				t.Errorf("%v blobs stored after the purge, want only the shared one", blobs)
+			}
+		}
+	})
+}
+
+func TestStorageCloseTwice(t *testing.T) {
+	for _, ts := range testStorages {
+		t.Run(ts.name, func(t *testing.T) {
+			s := ts.open(t, testStoreConfig(t))
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("second Close: %v", err)
+			}
+		})
+	}
+}
@@ -1,8 +1,7 @@
 package stare
 
 import (
-	"io"
-	"net/http"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -10,45 +9,71 @@ import (
 type DiscordMessage struct {
 	Message     *discordgo.Message
 	Attachments []*Attachment
+	// Revisions are the earlier versions of the message, oldest first, so
+	// the original message is revision 0 and Message is revision
+	// len(Revisions)
+	Revisions []*MessageRevision
 }
 
-func NewDiscordMessage(msg *discordgo.Message, maxSize int) *DiscordMessage {
-	m := &DiscordMessage{
-		Message:     msg,
-		Attachments: []*Attachment{},
+// MessageRevision is a version of a message from before it was edited.
+type MessageRevision struct {
+	Content string
+	// Timestamp is when the message was sent or edited to this version
+	Timestamp   time.Time
+	Embeds      []*discordgo.MessageEmbed
+	Attachments []*discordgo.MessageAttachment
+}
+
+// Revision returns the revision number of the current version of the message.
+func (m *DiscordMessage) Revision() int {
+	return len(m.Revisions)
+}
+
+// AddRevision makes edited the current version of the message, keeping the
+// previous version as a revision.
+func (m *DiscordMessage) AddRevision(edited *discordgo.Message) {
+	msg := m.Message
+	timestamp := msg.Timestamp
+	if msg.EditedTimestamp != nil {
+		timestamp = *msg.EditedTimestamp
 	}
+	m.Revisions = append(m.Revisions, &MessageRevision{
+		Content:     msg.Content,
+		Timestamp:   timestamp,
+		Embeds:      msg.Embeds,
+		Attachments: msg.Attachments,
+	})
 
-	for _, a := range msg.Attachments {
-		if a.Size > maxSize {
-			continue
-		}
-
-		data, err := GetAttachment(a.URL)
-		if err != nil {
-			continue
-		}
-
-		m.Attachments = append(m.Attachments, &Attachment{
-			Filename: a.Filename,
-			Size:     a.Size,
-			Data:     data,
-		})
+	updated := *msg
+	updated.Content = edited.Content
+	updated.EditedTimestamp = edited.EditedTimestamp
+	if updated.EditedTimestamp == nil {
+		now := time.Now().UTC()
+		updated.EditedTimestamp = &now
 	}
-	return m
+	if edited.Embeds != nil {
+		updated.Embeds = edited.Embeds
+	}
+	if edited.Attachments != nil {
+		updated.Attachments = edited.Attachments
+	}
+	m.Message = &updated
 }
 
-func GetAttachment(url string) ([]byte, error) {
-	res, err := http.Get(url)
-	if err != nil {
-		return nil, err
+// NewDiscordMessage wraps msg without any attachment data. Attachments are
+// downloaded afterwards by an AttachmentFetcher.
+func NewDiscordMessage(msg *discordgo.Message) *DiscordMessage {
+	return &DiscordMessage{
+		Message:     msg,
+		Attachments: []*Attachment{},
 	}
-	defer res.Body.Close()
-
-	return io.ReadAll(res.Body)
 }
 
 type Attachment struct {
 	Filename string
 	Size     int
-	Data     []byte
+	// Hash is the content hash the data is stored under in a BlobStore, if
+	// it has been stored there
+	Hash string
+	Data []byte
 }
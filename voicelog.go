@@ -0,0 +1,119 @@
+package stare
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/intrntsrfr/meido/pkg/utils/builders"
+)
+
+// VoiceSession is the voice state of a member who is in a voice channel.
+type VoiceSession struct {
+	ChannelID string
+	// Mute and Deaf are set when the member is muted or deafened by the
+	// server, rather than by themselves
+	Mute       bool
+	Deaf       bool
+	SelfStream bool
+	// JoinedAt is when the member joined voice, moving between channels
+	// doesn't change it
+	JoinedAt time.Time
+}
+
+func newVoiceSession(vs *discordgo.VoiceState, joinedAt time.Time) *VoiceSession {
+	return &VoiceSession{
+		ChannelID:  vs.ChannelID,
+		Mute:       vs.Mute,
+		Deaf:       vs.Deaf,
+		SelfStream: vs.SelfStream,
+		JoinedAt:   joinedAt,
+	}
+}
+
+// formatDuration formats d in hours, minutes and seconds, like 1h 5m 30s.
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+
+	var parts []string
+	if h > 0 {
+		parts = append(parts, fmt.Sprintf("%vh", h))
+	}
+	if m > 0 {
+		parts = append(parts, fmt.Sprintf("%vm", m))
+	}
+	if s > 0 || len(parts) == 0 {
+		parts = append(parts, fmt.Sprintf("%vs", s))
+	}
+	return strings.Join(parts, " ")
+}
+
+// voiceStateEmbeds describes how the voice state of a member changed from
+// old, which is nil if they weren't in voice. It returns no embeds for
+// changes that aren't logged, like muting themselves.
+func voiceStateEmbeds(old *VoiceSession, vs *discordgo.VoiceState, now time.Time) []*discordgo.MessageEmbed {
+	user := fmt.Sprintf("<@%v>", vs.UserID)
+	thumbnail := ""
+	if vs.Member != nil && vs.Member.User != nil {
+		user = fmt.Sprintf("%v\n%v", vs.Member.User.Mention(), vs.Member.User.String())
+		thumbnail = vs.Member.User.AvatarURL("256")
+	}
+	embed := func(title string, color Color) *builders.EmbedBuilder {
+		e := builders.NewEmbedBuilder().
+			WithTitle(title).
+			AddField("User", user, false).
+			WithFooter(fmt.Sprintf("User ID: %v", vs.UserID), "").
+			WithColor(int(color))
+		if thumbnail != "" {
+			e.WithThumbnail(thumbnail)
+		}
+		return e
+	}
+
+	switch {
+	case old == nil && vs.ChannelID == "":
+		return nil
+	case old == nil:
+		e := embed("Joined Voice", ColorGreen).
+			AddField("Channel", formatChannel(vs.ChannelID), false)
+		return []*discordgo.MessageEmbed{e.Build()}
+	case vs.ChannelID == "":
+		e := embed("Left Voice", ColorOrange).
+			AddField("Channel", formatChannel(old.ChannelID), false).
+			AddField("Session length", formatDuration(now.Sub(old.JoinedAt)), false)
+		return []*discordgo.MessageEmbed{e.Build()}
+	}
+
+	var embeds []*discordgo.MessageEmbed
+	if old.ChannelID != vs.ChannelID {
+		e := embed("Moved Voice Channel", ColorBlue).
+			AddField("From", formatChannel(old.ChannelID), true).
+			AddField("To", formatChannel(vs.ChannelID), true)
+		embeds = append(embeds, e.Build())
+	}
+
+	toggles := []struct {
+		before, after bool
+		on, off       string
+		color         Color
+	}{
+		{old.Mute, vs.Mute, "Server Muted", "Server Unmuted", ColorRed},
+		{old.Deaf, vs.Deaf, "Server Deafened", "Server Undeafened", ColorRed},
+		{old.SelfStream, vs.SelfStream, "Started Streaming", "Stopped Streaming", ColorWhite},
+	}
+	for _, t := range toggles {
+		if t.before == t.after {
+			continue
+		}
+		title := t.off
+		if t.after {
+			title = t.on
+		}
+		e := embed(title, t.color).
+			AddField("Channel", formatChannel(vs.ChannelID), false)
+		embeds = append(embeds, e.Build())
+	}
+	return embeds
+}